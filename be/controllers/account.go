@@ -0,0 +1,60 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/services"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/types"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/utils"
+)
+
+type AccountController struct {
+	userService         *services.UserService
+	authService         *services.AuthService
+	transparencyService *services.TransparencyService
+	socketController    *SocketController
+}
+
+func NewAccountController(us *services.UserService, as *services.AuthService, ts *services.TransparencyService, socketController *SocketController) *AccountController {
+	return &AccountController{userService: us, authService: as, transparencyService: ts, socketController: socketController}
+}
+
+func (a *AccountController) DeleteAccount(c *gin.Context) {
+	var req types.AccountDeletionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		types.FailResponse(c, http.StatusBadRequest, "Bad Request", err.Error())
+		return
+	}
+
+	user, err := a.userService.GetUserByUsername(c, c.GetString("username"))
+	if err != nil {
+		types.FailResponse(c, http.StatusUnauthorized, "User not found", nil)
+		return
+	}
+
+	friends, err := a.userService.GetFriends(c, user.Username)
+	if err != nil {
+		types.FailResponse(c, http.StatusInternalServerError, "Failed to load friends", err.Error())
+		return
+	}
+
+	if err := a.authService.DeleteAccount(c, user, req); err != nil {
+		types.FailResponse(c, http.StatusBadRequest, "Account deletion rejected", err.Error())
+		return
+	}
+
+	// an empty key marks the binding as ended, the log itself is append-only
+	if _, err := a.transparencyService.Append(c, user.Username, types.PublicKey{}); err != nil {
+		log.Println("Failed to append deletion to key log:", err)
+	}
+
+	a.socketController.CloseUser(user.Username)
+	for _, friend := range friends {
+		a.socketController.SendContactDeleted(friend.Username, user.Username)
+	}
+
+	utils.SetRefreshCookie(c, "", -1)
+	types.SuccessResponse(c, "Account deleted", nil)
+}
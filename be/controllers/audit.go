@@ -0,0 +1,59 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/services"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/types"
+)
+
+type AuditController struct {
+	auditService *services.AuditService
+}
+
+func NewAuditController(auditService *services.AuditService) *AuditController {
+	return &AuditController{auditService: auditService}
+}
+
+// SecurityActivity lists the caller's own security events, newest first.
+func (a *AuditController) SecurityActivity(c *gin.Context) {
+	var q types.AuditQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		types.FailResponse(c, http.StatusBadRequest, "Bad Request", err.Error())
+		return
+	}
+	// users only get to filter their own events
+	q.UserID, q.Username, q.IPAddress = c.GetString("UserId"), "", ""
+
+	events, err := a.auditService.Query(c, q)
+	if err != nil {
+		types.FailResponse(c, http.StatusBadRequest, "Failed to load security activity", err.Error())
+		return
+	}
+	types.SuccessResponse(c, "Security activity", events)
+}
+
+func (a *AuditController) QueryEvents(c *gin.Context) {
+	var q types.AuditQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		types.FailResponse(c, http.StatusBadRequest, "Bad Request", err.Error())
+		return
+	}
+
+	events, err := a.auditService.Query(c, q)
+	if err != nil {
+		types.FailResponse(c, http.StatusBadRequest, "Failed to query audit log", err.Error())
+		return
+	}
+	types.SuccessResponse(c, "Audit events", events)
+}
+
+func (a *AuditController) VerifyChain(c *gin.Context) {
+	status, err := a.auditService.VerifyChain(c)
+	if err != nil {
+		types.FailResponse(c, http.StatusInternalServerError, "Failed to verify audit log", err.Error())
+		return
+	}
+	types.SuccessResponse(c, "Audit log verification", status)
+}
@@ -1,6 +1,8 @@
 package controllers
 
 import (
+	"errors"
+	"log"
 	"net/http"
 	"time"
 
@@ -16,12 +18,14 @@ type AuthController struct{
 	// services 
 	userService *services.UserService
 	authService *services.AuthService
+	transparencyService *services.TransparencyService
 }
 
-func NewAuthController(userService *services.UserService, authService *services.AuthService) *AuthController {
+func NewAuthController(userService *services.UserService, authService *services.AuthService, transparencyService *services.TransparencyService) *AuthController {
 	return &AuthController{
 		userService: userService,
 		authService: authService,
+		transparencyService: transparencyService,
 	}
 }
 
@@ -33,20 +37,28 @@ func (a *AuthController) ReqChallenge(c *gin.Context) {
 		return
 	}
 
-	if err := a.userService.CheckUserExists(c, req.Username); err != nil {
+	user, err := a.userService.GetLoginUser(c, req.Username)
+	if err != nil {
 		types.FailResponse(c, http.StatusUnauthorized, "Invalid credentials", nil)
 		return
 	}
 
-	nonce, err := services.GenerateNonce()
+	nonce, err := a.authService.IssueChallenge(c, user.Username)
+	var tooMany *services.TooManyChallengesError
+	if errors.As(err, &tooMany) {
+		types.TooManyRequestsResponse(c, "Too many outstanding challenges", tooMany.RetryAfter)
+		return
+	}
 	if err != nil {
 		types.FailResponse(c, http.StatusInternalServerError, "Failed to generate nonce", err.Error())
 		return
 	}
 
-	services.StoreNonce(req.Username, nonce, 2*time.Minute)
-
-	types.SuccessResponse(c, "Challenge generated", types.ChallengeResponse{Nonce: nonce})
+	types.SuccessResponse(c, "Challenge generated", types.ChallengeResponse{
+		Nonce:       nonce,
+		Username:    user.Username,
+		KeyUsername: services.KeyUsername(user),
+	})
 }
 
 func (a *AuthController) Login(c *gin.Context) {
@@ -57,7 +69,7 @@ func (a *AuthController) Login(c *gin.Context) {
         return
     }
 
-	user, err := a.userService.GetUserByUsername(c, loginPayload.Username)
+	user, err := a.userService.GetLoginUser(c, loginPayload.Username)
 	if err != nil {
 		types.FailResponse(c, http.StatusUnauthorized, "Invalid credentials", nil)
 		return
@@ -69,6 +81,11 @@ func (a *AuthController) Login(c *gin.Context) {
 	} 
 
 	accessToken, refreshToken, err := a.authService.ProcessLogin(c, user, publicKey, loginPayload)
+	var locked *services.LoginLockedError
+	if errors.As(err, &locked) {
+		types.TooManyRequestsResponse(c, "Too many failed login attempts", locked.RetryAfter)
+		return
+	}
 	if err != nil {
 		types.FailResponse(c, http.StatusUnauthorized, "Invalid credentials", nil)
 		return
@@ -81,27 +98,118 @@ func (a *AuthController) Login(c *gin.Context) {
 		"username":     user.Username,
 	})
 }
+func (a *AuthController) ReqRegisterChallenge(c *gin.Context) {
+	var req types.NonceChallengeRequest
+
+	if err := c.ShouldBindQuery(&req); err != nil {
+		types.FailResponse(c, http.StatusBadRequest, "Bad Request", err.Error())
+		return
+	}
+
+	username, err := utils.ValidateUsername(req.Username)
+	if err != nil {
+		types.FailResponse(c, http.StatusBadRequest, "Invalid username", err.Error())
+		return
+	}
+	req.Username = username
+
+	if err := a.userService.CheckUsernameAvailable(c, req.Username); err != nil {
+		if errors.Is(err, services.ErrUsernameTaken) || errors.Is(err, services.ErrUsernameConfusable) || errors.Is(err, services.ErrUsernameReserved) {
+			types.FailResponse(c, http.StatusConflict, "Username not available", err.Error())
+			return
+		}
+		types.FailResponse(c, http.StatusInternalServerError, "Failed to check username", err.Error())
+		return
+	}
+
+	nonce, err := a.authService.IssueRegistrationChallenge(c, req.Username)
+	var tooMany *services.TooManyChallengesError
+	if errors.As(err, &tooMany) {
+		types.TooManyRequestsResponse(c, "Too many outstanding challenges", tooMany.RetryAfter)
+		return
+	}
+	if err != nil {
+		types.FailResponse(c, http.StatusInternalServerError, "Failed to generate nonce", err.Error())
+		return
+	}
+
+	types.SuccessResponse(c, "Challenge generated", types.ChallengeResponse{Nonce: nonce})
+}
+
 func (a *AuthController) Register(c *gin.Context) {
-	var payload types.IdentityPayload
+	var payload types.RegisterRequest
 
     if err := c.ShouldBindJSON(&payload); err != nil {
         types.FailResponse(c, http.StatusBadRequest, "Bad Request", err)
 		return
 	}
 
+	username, err := utils.ValidateUsername(payload.Username)
+	if err != nil {
+		types.FailResponse(c, http.StatusBadRequest, "Invalid username", err.Error())
+		return
+	}
+	payload.Username = username
+
+	if err := a.authService.VerifyRegistration(c, payload); err != nil {
+		types.FailResponse(c, http.StatusBadRequest, "Invalid identity key", err.Error())
+		return
+	}
+
+	// checked again, the name may have been taken or reserved since the challenge was issued
+	if err := a.userService.CheckUsernameAvailable(c, payload.Username); err != nil {
+		if errors.Is(err, services.ErrUsernameTaken) || errors.Is(err, services.ErrUsernameConfusable) || errors.Is(err, services.ErrUsernameReserved) {
+			types.FailResponse(c, http.StatusConflict, "Username not available", err.Error())
+			return
+		}
+		types.FailResponse(c, http.StatusInternalServerError, "Failed to check username", err.Error())
+		return
+	}
+
 	user, err := a.userService.CreateUser(c, payload.Username, payload.PublicKeyHex)
 	if err != nil {
 		if _, ok := db.IsErrUniqueConstraint(err); ok {
-			types.FailResponse(c, http.StatusConflict, "Email already registered", err)
+			types.FailResponse(c, http.StatusConflict, "Username not available", "username already registered or too similar to an existing user")
 			return
 		}
 		types.FailResponse(c, http.StatusInternalServerError, "Failed to register user", err.Error())
 		return
 	}
 
+	// a failed append is repaired by the next lookup of the key, see InclusionProof
+	if _, err := a.transparencyService.Append(c, user.Username, payload.PublicKeyHex); err != nil {
+		log.Println("Failed to append registered key to key log:", err)
+	}
+
 	types.SuccessResponse(c, "User registered successfully", user.Username)
 }
 
+func (a *AuthController) RotateKeys(c *gin.Context) {
+	var req types.KeyRotationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		types.FailResponse(c, http.StatusBadRequest, "Bad Request", err.Error())
+		return
+	}
+
+	user, err := a.userService.GetUserByUsername(c, c.GetString("username"))
+	if err != nil {
+		types.FailResponse(c, http.StatusUnauthorized, "User not found", nil)
+		return
+	}
+
+	key, err := a.authService.RotateIdentityKey(c, user, req)
+	if err != nil {
+		types.FailResponse(c, http.StatusBadRequest, "Key rotation rejected", err.Error())
+		return
+	}
+
+	if _, err := a.transparencyService.Append(c, user.Username, req.PublicKeyHex); err != nil {
+		log.Println("Failed to append rotated key to key log:", err)
+	}
+
+	types.SuccessResponse(c, "Identity key rotated", services.UserKeyFromModel(key))
+}
+
 func (a *AuthController) RefreshToken(c *gin.Context) {
 	refreshToken, err := c.Cookie("refresh_token")
 	if err != nil {
@@ -115,12 +223,20 @@ func (a *AuthController) RefreshToken(c *gin.Context) {
 		return
 	}
 
-	accessToken, err := middleware.GenerateAccessToken(session.UserID, claims.Username)
+	newRefreshToken, err := a.authService.RotateRefreshToken(c, claims, session, refreshToken)
+	if err != nil {
+		types.FailResponse(c, http.StatusUnauthorized, "Invalid refresh token or session", err.Error())
+		return
+	}
+
+	accessToken, err := middleware.GenerateAccessToken(session.UserID, claims.Username, session.ID)
 	if err != nil {
 		types.FailResponse(c, http.StatusInternalServerError, "Failed to generate access token", err.Error())
 		return
 	}
 
+	utils.SetRefreshCookie(c, newRefreshToken, int(time.Until(session.ExpiresAt).Seconds()))
+
 	types.SuccessResponse(c, "Access token refreshed successfully", gin.H{
 		"access_token": accessToken,
 		"username":     claims.Username,
@@ -143,6 +259,8 @@ func (a *AuthController) Logout(c *gin.Context) {
 		types.FailResponse(c, http.StatusInternalServerError, "Failed revoke refresh token", err.Error())
 		return
 	}
+	// the access token used for this request may belong to another session than the cookie
+	middleware.Revocations.Revoke(c.GetString("TokenId"))
 
 	c.SetCookie(
 		"refresh_token",
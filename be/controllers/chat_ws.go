@@ -3,106 +3,1026 @@ package controllers
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"log"
+	"net"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/middleware"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/prisma/db"
 	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/services"
 	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/types"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/utils"
 )
 
 type SocketController struct {
-    userService *services.UserService
-    chatService *services.ChatService
-    upgrader    websocket.Upgrader
-    clients     sync.Map
+    userService   *services.UserService
+    chatService   *services.ChatService
+    deviceService *services.DeviceService
+    authService   *services.AuthService
+    presence      *services.PresenceService
+    upgrader      websocket.Upgrader
+    conns         *connRegistry
+
+    bus    services.Bus
+    subsMu sync.Mutex
+    subs   map[string]func() // username -> unsubscribe from their bus channel
+}
+
+// socketClient is one open chat socket and who it was opened by.
+type socketClient struct {
+    id        string
+    conn      *websocket.Conn
+    userID    string
+    username  string
+    sessionID string
+    deviceID  string
+
+    mu        sync.Mutex
+    expiresAt time.Time     // expiry of the access token the socket is authenticated with
+    reauthed  chan struct{} // signalled when expiresAt moves
+
+    version int // protocol version agreed on in the hello frame, 0 before it
+
+    queue     chan outboundFrame // drained by writePump, the only goroutine writing data frames
+    replayed  chan []byte        // unbuffered, replay waits for writePump instead of filling queue
+    closed    chan struct{}      // closed once the socket is shut down
+    closeOnce sync.Once
+
+    // Messages are held back until the socket goes live, i.e. until the replay asked for in
+    // hello is done or hello asked for none. Guarded by mu.
+    live      bool
+    replaying bool
+    held      []types.IncomingPayload
 }
 
-func NewSocketController(us *services.UserService, cs *services.ChatService) *SocketController {
-    return &SocketController{
-        userService: us,
-        chatService: cs,
+// outboundFrame is an encoded envelope waiting in a client's send queue, or a close frame
+// when closeCode is set.
+type outboundFrame struct {
+    data      []byte
+    closeCode int
+    reason    string
+}
+
+var errSocketClosed = errors.New("socket is closed")
+var errSlowConsumer = errors.New("send queue is full")
+
+func encodeFrame(frameType, id string, payload interface{}) ([]byte, error) {
+    raw, err := json.Marshal(payload)
+    if err != nil {
+        return nil, err
+    }
+    return json.Marshal(types.Envelope{
+        Type:    frameType,
+        ID:      id,
+        V:       types.WS_PROTOCOL_VERSION,
+        Payload: raw,
+    })
+}
+
+// send queues one envelope for the socket. id is the id of the client frame it answers, if any.
+func (c *socketClient) send(frameType, id string, payload interface{}) error {
+    data, err := encodeFrame(frameType, id, payload)
+    if err != nil {
+        return err
+    }
+    return c.enqueue(outboundFrame{data: data})
+}
+
+// sendReplayed hands a replayed message to the writer and waits until it is taken, so a
+// long replay never overflows the send queue.
+func (c *socketClient) sendReplayed(msg types.IncomingPayload) error {
+    data, err := encodeFrame(types.FrameMessage, "", msg)
+    if err != nil {
+        return err
+    }
+    select {
+    case c.replayed <- data:
+        return nil
+    case <-c.closed:
+        return errSocketClosed
+    }
+}
+
+// sendMessage delivers a live message, or holds it back while the socket is not live yet.
+func (c *socketClient) sendMessage(msg types.IncomingPayload) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.live {
+        _ = c.send(types.FrameMessage, "", msg)
+        return
+    }
+    if len(c.held) >= types.WS_SEND_QUEUE {
+        // nothing is lost, the messages are replayed on the next connection
+        log.Printf("Disconnecting socket %s of %s: too many messages held back", c.id, c.username)
+        go c.closeNow(closeSlowConsumer, "too many messages held back")
+        return
+    }
+    c.held = append(c.held, msg)
+}
+
+// startReplay reports whether a replay may start, which is once and only before the socket went live.
+func (c *socketClient) startReplay() bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.live || c.replaying {
+        return false
+    }
+    c.replaying = true
+    return true
+}
+
+// goLive sends the held messages, except those already replayed, and delivers messages right
+// away from then on. synced is sent first when the socket comes out of a replay.
+func (c *socketClient) goLive(replayed map[string]bool, synced *types.SyncedPayload) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.live || (c.replaying && synced == nil) {
+        return
+    }
+    if synced != nil {
+        _ = c.send(types.FrameSynced, "", synced)
+    }
+    for _, msg := range c.held {
+        if !replayed[msg.ID] {
+            _ = c.send(types.FrameMessage, "", msg)
+        }
+    }
+    c.live, c.replaying, c.held = true, false, nil
+}
+
+// enqueue never blocks the caller. A client whose queue is full does not read fast enough
+// and is disconnected rather than holding up everyone writing to it.
+func (c *socketClient) enqueue(frame outboundFrame) error {
+    select {
+    case <-c.closed:
+        return errSocketClosed
+    default:
+    }
+    select {
+    case c.queue <- frame:
+        return nil
+    default:
+        log.Printf("Disconnecting socket %s of %s: send queue full", c.id, c.username)
+        go c.closeNow(closeSlowConsumer, "send queue full")
+        return errSlowConsumer
+    }
+}
+
+// writePump writes the queued frames in order and pings the client every WS_PING_PERIOD.
+// Queued frames go before replayed messages. A failed write shuts the socket down, which
+// ends the read loop as well.
+func (c *socketClient) writePump() {
+    ticker := time.NewTicker(types.WS_PING_PERIOD)
+    defer ticker.Stop()
+    for {
+        select {
+        case frame := <-c.queue:
+            if !c.writeFrame(frame) {
+                return
+            }
+            continue
+        default:
+        }
+        select {
+        case <-c.closed:
+            return
+        case frame := <-c.queue:
+            if !c.writeFrame(frame) {
+                return
+            }
+        case data := <-c.replayed:
+            if !c.writeFrame(outboundFrame{data: data}) {
+                return
+            }
+        case <-ticker.C:
+            if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(types.WS_WRITE_WAIT)); err != nil {
+                c.writeFailed(err)
+                return
+            }
+        }
+    }
+}
+
+// writeFrame writes one frame and reports whether the socket is still open.
+func (c *socketClient) writeFrame(frame outboundFrame) bool {
+    if frame.closeCode != 0 {
+        c.closeNow(frame.closeCode, frame.reason)
+        return false
+    }
+    _ = c.conn.SetWriteDeadline(time.Now().Add(types.WS_WRITE_WAIT))
+    if err := c.conn.WriteMessage(websocket.TextMessage, frame.data); err != nil {
+        c.writeFailed(err)
+        return false
+    }
+    return true
+}
+
+// closeAfterQueued closes the socket with code once the frames queued before are written.
+func (c *socketClient) closeAfterQueued(code int, reason string) {
+    _ = c.enqueue(outboundFrame{closeCode: code, reason: reason})
+}
+
+// closeNow sends a close frame right away, dropping whatever is still queued.
+func (c *socketClient) closeNow(code int, reason string) {
+    msg := websocket.FormatCloseMessage(code, reason)
+    if err := c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil {
+        c.writeFailed(err)
+        return
+    }
+    c.shutdown()
+}
+
+func (c *socketClient) writeFailed(err error) {
+    if !errors.Is(err, net.ErrClosed) && !errors.Is(err, websocket.ErrCloseSent) {
+        log.Printf("Failed to write to socket %s of %s: %v", c.id, c.username, err)
+    }
+    c.shutdown()
+}
+
+// shutdown closes the connection once. The read loop then fails and unregisters the client.
+func (c *socketClient) shutdown() {
+    c.closeOnce.Do(func() {
+        close(c.closed)
+        _ = c.conn.Close()
+    })
+}
+
+func (c *socketClient) sendError(id, code, message string) {
+    _ = c.send(types.FrameError, id, types.ErrorPayload{
+        Code:      code,
+        Message:   message,
+        Timestamp: time.Now().Unix(),
+    })
+}
+
+func (c *socketClient) tokenExpiry() time.Time {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.expiresAt
+}
+
+func (c *socketClient) extendExpiry(expiresAt time.Time) {
+    c.mu.Lock()
+    c.expiresAt = expiresAt
+    c.mu.Unlock()
+    select {
+    case c.reauthed <- struct{}{}:
+    default:
+    }
+}
+
+// closeSessionRevoked is sent as the close code when the session behind a socket is revoked.
+const closeSessionRevoked = 4001
+
+// closeDeviceRevoked is sent as the close code when the device behind a socket is revoked.
+const closeDeviceRevoked = 4002
+
+// closeAccountDeleted is sent as the close code when the account behind a socket is deleted.
+const closeAccountDeleted = 4003
+
+// closeReauthTimeout is sent as the close code when the socket's access token expired
+// before the client sent a fresh one.
+const closeReauthTimeout = 4004
+
+// closeUnsupportedVersion is sent as the close code when client and server share no protocol version.
+const closeUnsupportedVersion = 4005
+
+// closeSlowConsumer is sent as the close code when the client let its send queue fill up.
+const closeSlowConsumer = 4006
+
+// frameHandler handles one type of client frame. It answers with an ack or error itself.
+type frameHandler func(s *SocketController, client *socketClient, env types.Envelope)
+
+// inboundFrames is the registry of frame types a client may send.
+var inboundFrames = map[string]frameHandler{
+    types.FrameHello:       (*SocketController).handleHello,
+    types.FrameMessage:     (*SocketController).handleMessage,
+    types.FrameReauth:      (*SocketController).handleReauth,
+    types.FrameAck:         (*SocketController).handleAck,
+    types.FrameDelivered:   (*SocketController).handleReceipt,
+    types.FrameRead:        (*SocketController).handleReceipt,
+    types.FramePresence:    (*SocketController).handlePresence,
+    types.FrameTypingStart: (*SocketController).handleTyping,
+    types.FrameTypingStop:  (*SocketController).handleTyping,
+}
+
+func NewSocketController(us *services.UserService, cs *services.ChatService, ds *services.DeviceService, as *services.AuthService, ps *services.PresenceService, bus services.Bus) *SocketController {
+    s := &SocketController{
+        userService:   us,
+        chatService:   cs,
+        deviceService: ds,
+        authService:   as,
+        presence:      ps,
+        conns:         newConnRegistry(),
+        bus:           bus,
+        subs:          make(map[string]func()),
         upgrader: websocket.Upgrader{
-            CheckOrigin: func(r *http.Request) bool { return true },
+            CheckOrigin:  func(r *http.Request) bool { return true },
+            Subprotocols: []string{types.WS_SUBPROTOCOL},
         },
     }
+    // revoked sessions are not tied to a user channel, every replica listens for them
+    bus.Subscribe(sessionsChannel, s.applySessionsEvent)
+    return s
 }
 
-func (s *SocketController) ChatWS(c *gin.Context) {
-    //middlware func
-    token := c.Query("token")
-    if token == "" {
-        c.Status(http.StatusUnauthorized)
+// socketIdentity is who a chat socket is opened for.
+type socketIdentity struct {
+    userID    string
+    username  string
+    sessionID string
+    expiresAt time.Time
+}
+
+// IssueTicket hands out a single use ticket for the ?ticket= parameter of ChatWS.
+func (s *SocketController) IssueTicket(c *gin.Context) {
+    ticket, err := s.authService.IssueWSTicket(c, c.GetString("UserId"), c.GetString("username"), c.GetString("SessionId"), c.GetTime("TokenExpiresAt"))
+    var tooMany *services.TooManyChallengesError
+    if errors.As(err, &tooMany) {
+        types.TooManyRequestsResponse(c, "Too many outstanding tickets", tooMany.RetryAfter)
         return
     }
+    if err != nil {
+        types.FailResponse(c, http.StatusInternalServerError, "Failed to issue ticket", err.Error())
+        return
+    }
+    types.SuccessResponse(c, "Socket ticket", types.WSTicketResponse{
+        Ticket:    ticket,
+        ExpiresIn: int(types.EXPIRATION_WS_TICKET.Seconds()),
+    })
+}
+
+// authenticateSocket accepts either a ticket from IssueTicket or an access token offered as
+// the "access_token.<jwt>" subprotocol. Access tokens in the URL are refused since URLs end
+// up in access logs, proxies and browser history.
+func (s *SocketController) authenticateSocket(c *gin.Context) (socketIdentity, error) {
+    if c.Query("token") != "" {
+        return socketIdentity{}, errors.New("access tokens are not accepted in the URL, use a ticket")
+    }
+
+    if ticket := c.Query("ticket"); ticket != "" {
+        claims, err := s.authService.RedeemWSTicket(c, ticket)
+        if err != nil {
+            return socketIdentity{}, err
+        }
+        if claims.SessionID == "" || middleware.Revocations.IsRevoked(claims.SessionID) {
+            return socketIdentity{}, errors.New("session has been revoked")
+        }
+        return socketIdentity{
+            userID:    claims.Subject,
+            username:  claims.Username,
+            sessionID: claims.SessionID,
+            expiresAt: time.Unix(claims.TokenExpiresAt, 0),
+        }, nil
+    }
+
+    token, offersChat := "", false
+    for _, protocol := range websocket.Subprotocols(c.Request) {
+        if protocol == types.WS_SUBPROTOCOL {
+            offersChat = true
+        } else if strings.HasPrefix(protocol, types.WS_TOKEN_PROTOCOL_PREFIX) {
+            token = strings.TrimPrefix(protocol, types.WS_TOKEN_PROTOCOL_PREFIX)
+        }
+    }
+    if token == "" {
+        return socketIdentity{}, errors.New("missing ticket or access token")
+    }
+    // the token protocol must never be echoed back, so the chat protocol has to be offered too
+    if !offersChat {
+        return socketIdentity{}, errors.New("the " + types.WS_SUBPROTOCOL + " subprotocol must be offered")
+    }
     claims, err := middleware.VerifyAccessToken(token)
     if err != nil {
-        types.FailResponse(c, http.StatusUnauthorized, "Invalid or expired token", err.Error())
+        return socketIdentity{}, err
+    }
+    if !middleware.Revocations.CheckAccessToken(claims) {
+        return socketIdentity{}, errors.New("session has been revoked")
+    }
+    return socketIdentity{
+        userID:    claims.Subject,
+        username:  claims.Username,
+        sessionID: claims.SessionID,
+        expiresAt: claims.ExpiresAt.Time,
+    }, nil
+}
+
+func (s *SocketController) ChatWS(c *gin.Context) {
+    identity, err := s.authenticateSocket(c)
+    if err != nil {
+        types.FailResponse(c, http.StatusUnauthorized, "Unauthorized", err.Error())
         c.Abort()
         return
     }
-    
-    username := claims.Username
-    if username == "" {
+
+    username := identity.username
+    userID := identity.userID
+    sessionID := identity.sessionID
+    if username == "" || userID == "" {
         c.Status(http.StatusUnauthorized)
         return
     }
+    deviceID := c.Query("device_id")
+    if deviceID != "" {
+        if _, err := s.deviceService.ActiveDevice(c, userID, deviceID); err != nil {
+            types.FailResponse(c, http.StatusForbidden, "Unknown or revoked device", nil)
+            return
+        }
+    }
     conn, err := s.upgrader.Upgrade(c.Writer, c.Request, nil)
     if err != nil {
         return
     }
-    s.clients.Store(username, conn)
+    client := &socketClient{
+        id:        uuid.NewString(),
+        conn:      conn,
+        userID:    userID,
+        username:  username,
+        sessionID: sessionID,
+        deviceID:  deviceID,
+        expiresAt: identity.expiresAt,
+        reauthed:  make(chan struct{}, 1),
+        queue:     make(chan outboundFrame, types.WS_SEND_QUEUE),
+        replayed:  make(chan []byte),
+        closed:    make(chan struct{}),
+    }
+    conn.SetReadLimit(types.WS_MAX_FRAME_SIZE)
+    _ = conn.SetReadDeadline(time.Now().Add(types.WS_PONG_WAIT))
+    conn.SetPongHandler(func(string) error {
+        return conn.SetReadDeadline(time.Now().Add(types.WS_PONG_WAIT))
+    })
+    go client.writePump()
+    go s.watchExpiry(client)
+    s.register(client)
+    // the session may have been revoked while the socket was being upgraded
+    if middleware.Revocations.IsRevoked(sessionID) {
+        s.closeSessions(sessionID)
+    }
+    if deviceID != "" {
+        if err := s.deviceService.TouchDevice(context.Background(), deviceID); err != nil {
+            log.Println("Failed to update device last seen:", err)
+        }
+    }
+    if s.presence.Connect(username, userID, client.id) {
+        s.broadcastPresence(username)
+    }
+    limiter := utils.NewRateLimiter(types.WS_MESSAGES_PER_SECOND, time.Second, types.WS_MESSAGE_BURST)
+    violations := 0
     for {
         _, data, err := conn.ReadMessage()
         if err != nil {
-            s.clients.Delete(username)
+            if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+                log.Printf("Socket %s of %s closed: %v", client.id, username, err)
+            }
+            client.shutdown()
+            s.unregister(client)
+            changed, err := s.presence.Disconnect(context.Background(), username, client.id)
+            if err != nil {
+                log.Println("Failed to store last seen:", err)
+            }
+            if changed {
+                s.broadcastPresence(username)
+            }
             break
         }
-        var in types.IncomingPayload
-        if err := json.Unmarshal(data, &in); err != nil {
+        if ok, wait := limiter.Allow(username); !ok {
+            violations++
+            if violations >= types.WS_MAX_RATE_VIOLATIONS {
+                client.closeNow(websocket.ClosePolicyViolation, "rate limit exceeded")
+                continue
+            }
+            _ = client.send(types.FrameError, "", types.ErrorPayload{
+                Code:         types.ErrCodeRateLimited,
+                Message:      "too many messages, slow down",
+                RetryAfterMs: wait.Milliseconds(),
+                Timestamp:    time.Now().Unix(),
+            })
             continue
         }
-        saved, err := s.chatService.SaveIncomingMessage(context.Background(), in)
-        if err != nil {
+        violations = 0
+        var env types.Envelope
+        if err := json.Unmarshal(data, &env); err != nil || env.Type == "" {
+            client.sendError("", types.ErrCodeBadFrame, "frames must be a JSON envelope with a type")
             continue
         }
-        s.writeTo(username, saved)
-        s.writeTo(in.ReceiverUsername, saved)
+        s.dispatch(client, env)
     }
 }
 
-func (s *SocketController) writeTo(username string, v interface{}) {
-    val, ok := s.clients.Load(username)
+// dispatch hands a client frame to the handler registered for its type. Every frame but
+// hello needs the version agreed on in the handshake.
+func (s *SocketController) dispatch(client *socketClient, env types.Envelope) {
+    handler, ok := inboundFrames[env.Type]
     if !ok {
+        client.sendError(env.ID, types.ErrCodeUnknownType, "unknown frame type "+env.Type)
         return
     }
-    conn, _ := val.(*websocket.Conn)
-    _ = conn.WriteJSON(v)
+    if env.Type != types.FrameHello {
+        if client.version == 0 {
+            client.sendError(env.ID, types.ErrCodeHelloRequired, "send a hello frame first")
+            return
+        }
+        if env.V != client.version {
+            client.sendError(env.ID, types.ErrCodeUnsupportedVersion, "frame version does not match the agreed version")
+            return
+        }
+    }
+    handler(s, client, env)
 }
 
-func (s *SocketController) SendFriendNotification(username, friendUsername string, friendshipID interface{}) {
-    notification := map[string]interface{}{
-        "type": "friendlist_changed",
-        "data": map[string]interface{}{
-            "username":      username,
-            "friendship_id": friendshipID,
-            "timestamp":     time.Now().Unix(),
-        },
+// handleHello agrees on the highest protocol version both sides speak.
+func (s *SocketController) handleHello(client *socketClient, env types.Envelope) {
+    var hello types.HelloPayload
+    if err := json.Unmarshal(env.Payload, &hello); err != nil {
+        client.sendError(env.ID, types.ErrCodeInvalidPayload, "hello payload could not be parsed")
+        return
+    }
+
+    version := 0
+    for _, v := range hello.Versions {
+        if slices.Contains(types.WS_SUPPORTED_VERSIONS, v) && v > version {
+            version = v
+        }
+    }
+    if version == 0 {
+        _ = client.send(types.FrameError, env.ID, types.ErrorPayload{
+            Code:              types.ErrCodeUnsupportedVersion,
+            Message:           "no common protocol version",
+            SupportedVersions: types.WS_SUPPORTED_VERSIONS,
+            Timestamp:         time.Now().Unix(),
+        })
+        client.closeAfterQueued(closeUnsupportedVersion, "unsupported protocol version")
+        return
+    }
+
+    resumeFrom := -1
+    if hello.LastMessageID != "" {
+        id, err := strconv.Atoi(hello.LastMessageID)
+        if err != nil || id < 0 {
+            client.sendError(env.ID, types.ErrCodeInvalidPayload, "last_message_id must be a message id")
+            return
+        }
+        resumeFrom = id
+    }
+    cursor, err := s.chatService.DeliveryCursor(context.Background(), client.userID)
+    if err != nil {
+        log.Println("Failed to load delivery cursor:", err)
+    }
+
+    client.version = version
+    _ = client.send(types.FrameWelcome, env.ID, types.WelcomePayload{
+        Version:   version,
+        Username:  client.username,
+        ExpiresAt: client.tokenExpiry().Unix(),
+        Cursor:    cursor,
+    })
+    if hello.ReceiptsSince > 0 {
+        s.syncReceipts(client, time.Unix(hello.ReceiptsSince, 0))
+    }
+    if resumeFrom < 0 {
+        client.goLive(nil, nil)
+    } else if client.startReplay() {
+        go s.replay(client, resumeFrom)
+    }
+    friends, err := s.userService.GetFriends(context.Background(), client.username)
+    if err != nil {
+        log.Println("Failed to load friends:", err)
+        return
+    }
+    for i := range friends {
+        _ = client.send(types.FramePresence, "", s.presence.Presence(&friends[i]))
     }
-    s.writeTo(friendUsername, notification)
 }
 
-func (s *SocketController) SendUnfriendNotification(username, friendUsername string) {
-    notification := map[string]interface{}{
-        "type": "friendlist_changed",
-        "data": map[string]interface{}{
-            "username":      username,
-            "friendship_id": nil,
-            "timestamp":     time.Now().Unix(),
-        },
+// replay sends every message of the user newer than after, oldest first, then a synced
+// frame, and then lets the live messages held back in the meantime through.
+func (s *SocketController) replay(client *socketClient, after int) {
+    ctx := context.Background()
+    last, replayed := after, map[string]bool{}
+    for {
+        page, err := s.chatService.MessagesAfter(ctx, client.userID, client.deviceID, last, types.WS_REPLAY_PAGE_SIZE)
+        if err != nil {
+            log.Println("Failed to load messages to replay:", err)
+            client.sendError("", types.ErrCodeInternal, "missed messages could not be loaded")
+            break
+        }
+        for _, msg := range page {
+            last, _ = strconv.Atoi(msg.ID)
+            if msg.EncryptedMessage == "" {
+                continue // encrypted per device, but not for this one
+            }
+            if err := client.sendReplayed(msg); err != nil {
+                return
+            }
+            replayed[msg.ID] = true
+        }
+        if len(page) < types.WS_REPLAY_PAGE_SIZE {
+            break
+        }
     }
-    s.writeTo(friendUsername, notification)
-}
\ No newline at end of file
+    client.goLive(replayed, &types.SyncedPayload{
+        LastMessageID: strconv.Itoa(last),
+        Replayed:      len(replayed),
+        Timestamp:     time.Now().Unix(),
+    })
+}
+
+// handleAck moves the user's delivery cursor up to the acknowledged message. Acks are
+// cumulative, so acking the newest message received is enough. Only acks with an id are
+// answered.
+func (s *SocketController) handleAck(client *socketClient, env types.Envelope) {
+    var req types.AckPayload
+    if err := json.Unmarshal(env.Payload, &req); err != nil || req.MessageID == "" {
+        client.sendError(env.ID, types.ErrCodeInvalidPayload, "ack payload needs a message_id")
+        return
+    }
+
+    err := s.chatService.AdvanceDeliveryCursor(context.Background(), client.userID, req.MessageID)
+    if errors.Is(err, services.ErrInvalidMessageID) {
+        client.sendError(env.ID, types.ErrCodeInvalidPayload, "unknown message_id")
+        return
+    }
+    if err != nil {
+        log.Println("Failed to advance delivery cursor:", err)
+        client.sendError(env.ID, types.ErrCodeInternal, "cursor could not be stored")
+        return
+    }
+    if env.ID != "" {
+        _ = client.send(types.FrameAck, env.ID, types.AckPayload{MessageID: req.MessageID, Timestamp: time.Now().Unix()})
+    }
+}
+
+// syncReceipts sends the receipts recorded while the client was away, one delivered and one
+// read frame per conversation naming the newest message covered.
+func (s *SocketController) syncReceipts(client *socketClient, since time.Time) {
+    receipts, err := s.chatService.ReceiptsSince(context.Background(), client.userID, since)
+    if err != nil {
+        log.Println("Failed to load receipts:", err)
+        return
+    }
+
+    // receipts are ordered by message, so the last one of each conversation is the newest
+    delivered, read := map[string]string{}, map[string]string{}
+    for _, r := range receipts {
+        if r.DeliveredAt != "" {
+            delivered[r.ReceiverUsername] = r.MessageID
+        }
+        if r.ReadAt != "" {
+            read[r.ReceiverUsername] = r.MessageID
+        }
+    }
+    for username, upTo := range delivered {
+        _ = client.send(types.FrameDelivered, "", types.ReceiptPayload{Username: username, UpTo: upTo})
+    }
+    for username, upTo := range read {
+        _ = client.send(types.FrameRead, "", types.ReceiptPayload{Username: username, UpTo: upTo})
+    }
+}
+
+// handleMessage stores a chat message, acks it with the stored ID and delivers it.
+func (s *SocketController) handleMessage(client *socketClient, env types.Envelope) {
+    var in types.IncomingPayload
+    if err := json.Unmarshal(env.Payload, &in); err != nil {
+        client.sendError(env.ID, types.ErrCodeInvalidPayload, "message payload could not be parsed")
+        return
+    }
+    if in.SenderUsername != "" && utils.CanonicalUsername(in.SenderUsername) != client.username {
+        client.sendError(env.ID, types.ErrCodeSenderMismatch, "sender does not match the authenticated user")
+        return
+    }
+
+    saved, err := s.chatService.SaveIncomingMessage(context.Background(), client.userID, client.deviceID, in)
+    switch {
+    case errors.Is(err, services.ErrInvalidSignature):
+        client.sendError(env.ID, types.ErrCodeInvalidSignature, "message signature could not be verified")
+        return
+    case errors.Is(err, services.ErrUnknownReceiver):
+        client.sendError(env.ID, types.ErrCodeUnknownReceiver, "receiver does not exist")
+        return
+    case errors.Is(err, services.ErrUnknownDevice):
+        client.sendError(env.ID, types.ErrCodeUnknownDevice, "a ciphertext is addressed to an unknown or revoked device")
+        return
+    case errors.Is(err, services.ErrMissingDevices):
+        client.sendError(env.ID, types.ErrCodeStaleDeviceList, "the receiver has devices without a ciphertext, refresh the device list")
+        return
+    case err != nil:
+        log.Println("Failed to save message:", err)
+        client.sendError(env.ID, types.ErrCodeInternal, "message could not be stored")
+        return
+    }
+
+    _ = client.send(types.FrameAck, env.ID, types.AckPayload{
+        MessageID: saved.ID,
+        Timestamp: time.Now().Unix(),
+    })
+    s.deliverMessage(client, saved)
+}
+
+// watchExpiry asks the client for a fresh access token WS_REAUTH_WARNING before the current
+// one expires, and closes the socket if none arrived by the time it does.
+func (s *SocketController) watchExpiry(client *socketClient) {
+    var warned time.Time
+    for {
+        expiry := client.tokenExpiry()
+        remaining := time.Until(expiry)
+        if remaining <= 0 {
+            client.closeNow(closeReauthTimeout, "access token expired")
+            return
+        }
+
+        wait := remaining
+        if !warned.Equal(expiry) {
+            if lead := remaining - types.WS_REAUTH_WARNING; lead > 0 {
+                wait = lead
+            } else {
+                _ = client.send(types.FrameReauthRequired, "", types.ReauthStatusPayload{
+                    ExpiresAt: expiry.Unix(),
+                    Timestamp: time.Now().Unix(),
+                })
+                warned = expiry
+            }
+        }
+
+        timer := time.NewTimer(wait)
+        select {
+        case <-client.closed:
+            timer.Stop()
+            return
+        case <-client.reauthed:
+            timer.Stop()
+        case <-timer.C:
+        }
+    }
+}
+
+// handleReceipt records that the client received or read the messages of a conversation up
+// to a message, and tells their sender.
+func (s *SocketController) handleReceipt(client *socketClient, env types.Envelope) {
+    var req types.ReceiptPayload
+    if err := json.Unmarshal(env.Payload, &req); err != nil || req.Username == "" {
+        client.sendError(env.ID, types.ErrCodeInvalidPayload, "receipt payload could not be parsed")
+        return
+    }
+
+    upTo, err := s.chatService.MarkReceipts(context.Background(), client.userID, req.Username, req.UpTo, env.Type)
+    switch {
+    case errors.Is(err, services.ErrUnknownReceiver):
+        client.sendError(env.ID, types.ErrCodeUnknownReceiver, "conversation partner does not exist")
+        return
+    case errors.Is(err, services.ErrInvalidMessageID):
+        client.sendError(env.ID, types.ErrCodeInvalidPayload, "up_to is not a message id")
+        return
+    case err != nil:
+        log.Println("Failed to store receipt:", err)
+        client.sendError(env.ID, types.ErrCodeInternal, "receipt could not be stored")
+        return
+    }
+
+    _ = client.send(types.FrameAck, env.ID, types.AckPayload{MessageID: upTo, Timestamp: time.Now().Unix()})
+    if upTo != "" {
+        s.SendReceipt(utils.CanonicalUsername(req.Username), env.Type, client.username, upTo)
+    }
+}
+
+// handlePresence switches the connection between online and away.
+func (s *SocketController) handlePresence(client *socketClient, env types.Envelope) {
+    var req types.PresenceUpdatePayload
+    if err := json.Unmarshal(env.Payload, &req); err != nil ||
+        (req.Status != types.PresenceOnline && req.Status != types.PresenceAway) {
+        client.sendError(env.ID, types.ErrCodeInvalidPayload, "status must be online or away")
+        return
+    }
+
+    if s.presence.SetAway(client.username, client.id, req.Status == types.PresenceAway) {
+        s.broadcastPresence(client.username)
+    }
+    _ = client.send(types.FrameAck, env.ID, types.AckPayload{Timestamp: time.Now().Unix()})
+}
+
+// handleTyping relays a typing indicator to a friend. Nothing is stored, and only frames
+// with an id are acked since they are sent often.
+func (s *SocketController) handleTyping(client *socketClient, env types.Envelope) {
+    var req types.TypingPayload
+    if err := json.Unmarshal(env.Payload, &req); err != nil || req.Username == "" {
+        client.sendError(env.ID, types.ErrCodeInvalidPayload, "typing payload could not be parsed")
+        return
+    }
+    to := utils.CanonicalUsername(req.Username)
+
+    friends, err := s.userService.GetFriends(context.Background(), client.username)
+    if err != nil {
+        client.sendError(env.ID, types.ErrCodeInternal, "friends could not be loaded")
+        return
+    }
+    if !slices.ContainsFunc(friends, func(f db.UserModel) bool { return f.Username == to }) {
+        client.sendError(env.ID, types.ErrCodeNotFriends, "typing indicators are only sent to friends")
+        return
+    }
+
+    s.writeTo(to, env.Type, types.TypingPayload{Username: client.username})
+    if env.ID != "" {
+        _ = client.send(types.FrameAck, env.ID, types.AckPayload{Timestamp: time.Now().Unix()})
+    }
+}
+
+// broadcastPresence sends username's current presence to their friends, and only to them.
+func (s *SocketController) broadcastPresence(username string) {
+    ctx := context.Background()
+    user, err := s.userService.GetUserByUsername(ctx, username)
+    if err != nil {
+        return
+    }
+    friends, err := s.userService.GetFriends(ctx, username)
+    if err != nil {
+        log.Println("Failed to load friends for presence:", err)
+        return
+    }
+
+    presence := s.presence.Presence(user)
+    for _, friend := range friends {
+        s.writeTo(friend.Username, types.FramePresence, presence)
+    }
+}
+
+// handleReauth moves the socket onto a fresh access token. The token has to belong to the
+// same user and session the socket was opened with.
+func (s *SocketController) handleReauth(client *socketClient, env types.Envelope) {
+    var req types.ReauthPayload
+    if err := json.Unmarshal(env.Payload, &req); err != nil {
+        client.sendError(env.ID, types.ErrCodeInvalidPayload, "reauth payload could not be parsed")
+        return
+    }
+    claims, err := middleware.VerifyAccessToken(req.Token)
+    if err != nil {
+        client.sendError(env.ID, types.ErrCodeReauthFailed, "invalid or expired token")
+        return
+    }
+    if claims.Subject != client.userID || claims.SessionID != client.sessionID {
+        client.sendError(env.ID, types.ErrCodeReauthFailed, "token belongs to another session")
+        return
+    }
+    if !middleware.Revocations.CheckAccessToken(claims) {
+        client.sendError(env.ID, types.ErrCodeReauthFailed, "session has been revoked")
+        return
+    }
+
+    client.extendExpiry(claims.ExpiresAt.Time)
+    _ = client.send(types.FrameReauthOK, env.ID, types.ReauthStatusPayload{
+        ExpiresAt: claims.ExpiresAt.Unix(),
+        Timestamp: time.Now().Unix(),
+    })
+}
+
+// deliverMessage hands a stored message to the sockets of sender and receiver, wherever
+// they are connected. The sending socket is skipped, it already got an ack.
+func (s *SocketController) deliverMessage(sender *socketClient, saved types.IncomingPayload) {
+    event := types.SocketEvent{Kind: types.SocketEventMessage, Message: &saved, SkipConn: sender.id}
+    s.publish(saved.ReceiverUsername, event)
+    if saved.SenderUsername != saved.ReceiverUsername {
+        s.publish(saved.SenderUsername, event)
+    }
+}
+
+// routeMessage gives each socket of username on this replica the ciphertext of its device.
+// Sockets that are not bound to a device get the account level ciphertext.
+func (s *SocketController) routeMessage(username string, msg types.IncomingPayload, skipConn string) {
+    copies := msg.Ciphertexts
+    msg.Ciphertexts = nil
+
+    for _, client := range s.conns.forUser(username) {
+        if client.id == skipConn {
+            continue
+        }
+        if client.deviceID == "" {
+            if msg.EncryptedMessage != "" {
+                client.sendMessage(msg)
+            }
+            continue
+        }
+        for _, dc := range copies {
+            if dc.DeviceID == client.deviceID {
+                out := msg
+                out.EncryptedMessage = dc.EncryptedMessage
+                out.DeviceID = dc.DeviceID
+                client.sendMessage(out)
+                break
+            }
+        }
+    }
+}
+
+// writeTo sends a frame to every connection of username, on any replica.
+func (s *SocketController) writeTo(username, frameType string, payload interface{}) {
+    raw, err := json.Marshal(payload)
+    if err != nil {
+        log.Printf("Failed to encode %s frame: %v", frameType, err)
+        return
+    }
+    s.publish(username, types.SocketEvent{Kind: types.SocketEventFrame, Frame: frameType, Payload: raw})
+}
+
+// closeClients unregisters the given connections and closes them with code.
+func (s *SocketController) closeClients(clients []*socketClient, code int, reason string) {
+    for _, client := range clients {
+        s.unregister(client)
+        client.closeNow(code, reason)
+    }
+}
+
+// CloseSessions disconnects the sockets opened with any of the given sessions, on any replica.
+func (s *SocketController) CloseSessions(sessionIDs ...string) {
+    s.publishTo(sessionsChannel, types.SocketEvent{
+        Kind:       types.SocketEventClose,
+        SessionIDs: sessionIDs,
+        CloseCode:  closeSessionRevoked,
+        Reason:     "session revoked",
+    })
+}
+
+// closeSessions disconnects the sockets opened with any of the given sessions on this replica.
+func (s *SocketController) closeSessions(sessionIDs ...string) {
+    for _, id := range sessionIDs {
+        s.closeClients(s.conns.forSession(id), closeSessionRevoked, "session revoked")
+    }
+}
+
+// CloseDevice disconnects the sockets username opened from the given device.
+func (s *SocketController) CloseDevice(username, deviceID string) {
+    s.publish(username, types.SocketEvent{
+        Kind:      types.SocketEventClose,
+        DeviceID:  deviceID,
+        CloseCode: closeDeviceRevoked,
+        Reason:    "device revoked",
+    })
+}
+
+// CloseUser disconnects every socket opened by username.
+func (s *SocketController) CloseUser(username string) {
+    s.publish(username, types.SocketEvent{
+        Kind:      types.SocketEventClose,
+        CloseCode: closeAccountDeleted,
+        Reason:    "account deleted",
+    })
+}
+
+// SendReceipt tells sender that reader received or read, depending on kind, their messages
+// up to and including upTo.
+func (s *SocketController) SendReceipt(sender, kind, reader, upTo string) {
+    s.writeTo(sender, kind, types.ReceiptPayload{
+        Username: reader,
+        UpTo:     upTo,
+        At:       time.Now().Unix(),
+    })
+}
+
+// SendContactDeleted tells a former friend that username deleted their account.
+func (s *SocketController) SendContactDeleted(friendUsername, username string) {
+    s.writeTo(friendUsername, types.FrameContactDeleted, types.ContactDeletedPayload{
+        Username:  username,
+        Timestamp: time.Now().Unix(),
+    })
+}
+
+// SendRecoveryEvent tells username about progress of a recovery request, e.g. that one was
+// opened for their account or that they are asked to approve one as guardian.
+func (s *SocketController) SendRecoveryEvent(username, kind, requestID string) {
+    s.writeTo(username, types.FrameRecovery, types.RecoveryEventPayload{
+        Kind:      kind,
+        RequestID: requestID,
+        Timestamp: time.Now().Unix(),
+    })
+}
+
+// SendSecurityAlert tells the user's open sockets that a replayed refresh token was detected
+// and the affected session has been revoked.
+func (s *SocketController) SendSecurityAlert(username, sessionID string) {
+    s.writeTo(username, types.FrameSecurityAlert, types.SecurityAlertPayload{
+        Reason:    "refresh_token_reuse",
+        SessionID: sessionID,
+        Timestamp: time.Now().Unix(),
+    })
+}
+
+func (s *SocketController) SendFriendNotification(username, friendUsername string, friendshipID interface{}) {
+    s.writeTo(friendUsername, types.FrameFriendlistChanged, types.FriendlistChangedPayload{
+        Username:     username,
+        FriendshipID: friendshipID,
+        Timestamp:    time.Now().Unix(),
+    })
+}
+
+func (s *SocketController) SendUnfriendNotification(username, friendUsername string) {
+    s.writeTo(friendUsername, types.FrameFriendlistChanged, types.FriendlistChangedPayload{
+        Username:     username,
+        FriendshipID: nil,
+        Timestamp:    time.Now().Unix(),
+    })
+}
@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/services"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/types"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/utils"
+)
+
+type DeviceController struct {
+	userService      *services.UserService
+	deviceService    *services.DeviceService
+	socketController *SocketController
+}
+
+func NewDeviceController(us *services.UserService, ds *services.DeviceService, socketController *SocketController) *DeviceController {
+	return &DeviceController{userService: us, deviceService: ds, socketController: socketController}
+}
+
+func (d *DeviceController) ReqDeviceChallenge(c *gin.Context) {
+	nonce, err := d.deviceService.IssueDeviceChallenge(c, c.GetString("username"))
+	var tooMany *services.TooManyChallengesError
+	if errors.As(err, &tooMany) {
+		types.TooManyRequestsResponse(c, "Too many outstanding challenges", tooMany.RetryAfter)
+		return
+	}
+	if err != nil {
+		types.FailResponse(c, http.StatusInternalServerError, "Failed to generate nonce", err.Error())
+		return
+	}
+
+	types.SuccessResponse(c, "Challenge generated", types.ChallengeResponse{Nonce: nonce})
+}
+
+func (d *DeviceController) RegisterDevice(c *gin.Context) {
+	var req types.DeviceRegistrationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		types.FailResponse(c, http.StatusBadRequest, "Bad Request", err.Error())
+		return
+	}
+
+	user, err := d.userService.GetUserByUsername(c, c.GetString("username"))
+	if err != nil {
+		types.FailResponse(c, http.StatusUnauthorized, "User not found", nil)
+		return
+	}
+
+	device, err := d.deviceService.RegisterDevice(c, user, req)
+	if errors.Is(err, services.ErrTooManyDevices) {
+		types.FailResponse(c, http.StatusConflict, "Device limit reached, revoke a device first", nil)
+		return
+	}
+	if err != nil {
+		types.FailResponse(c, http.StatusBadRequest, "Device registration rejected", err.Error())
+		return
+	}
+
+	types.SuccessResponse(c, "Device registered", services.DeviceFromModel(device))
+}
+
+func (d *DeviceController) ListMyDevices(c *gin.Context) {
+	devices, err := d.deviceService.ListDevices(c, c.GetString("username"))
+	if err != nil {
+		types.FailResponse(c, http.StatusInternalServerError, "Failed to list devices", err.Error())
+		return
+	}
+
+	types.SuccessResponse(c, "Active devices", devices)
+}
+
+// ListUserDevices returns the devices of another user, which a sender needs to encrypt one copy per device.
+func (d *DeviceController) ListUserDevices(c *gin.Context) {
+	username := utils.CanonicalUsername(c.Param("username"))
+	if err := d.userService.CheckUserExists(c, username); err != nil {
+		types.FailResponse(c, http.StatusNotFound, "User not found", nil)
+		return
+	}
+
+	devices, err := d.deviceService.ListDevices(c, username)
+	if err != nil {
+		types.FailResponse(c, http.StatusInternalServerError, "Failed to list devices", err.Error())
+		return
+	}
+
+	types.SuccessResponse(c, "Active devices", devices)
+}
+
+func (d *DeviceController) RevokeDevice(c *gin.Context) {
+	deviceID := c.Param("id")
+	user, err := d.userService.GetUserByUsername(c, c.GetString("username"))
+	if err != nil {
+		types.FailResponse(c, http.StatusUnauthorized, "User not found", nil)
+		return
+	}
+
+	err = d.deviceService.RevokeDevice(c, user, deviceID)
+	if errors.Is(err, services.ErrDeviceNotFound) {
+		types.FailResponse(c, http.StatusNotFound, "Device not found", nil)
+		return
+	}
+	if err != nil {
+		types.FailResponse(c, http.StatusInternalServerError, "Failed to revoke device", err.Error())
+		return
+	}
+
+	d.socketController.CloseDevice(user.Username, deviceID)
+	types.SuccessResponse(c, "Device revoked", nil)
+}
@@ -0,0 +1,55 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/services"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/types"
+)
+
+type PresenceController struct {
+	userService     *services.UserService
+	presenceService *services.PresenceService
+}
+
+func NewPresenceController(us *services.UserService, ps *services.PresenceService) *PresenceController {
+	return &PresenceController{userService: us, presenceService: ps}
+}
+
+// FriendsPresence lists the presence of the caller's friends.
+func (p *PresenceController) FriendsPresence(c *gin.Context) {
+	friends, err := p.userService.GetFriends(c, c.GetString("username"))
+	if err != nil {
+		types.FailResponse(c, http.StatusInternalServerError, "Failed to load friends", err.Error())
+		return
+	}
+
+	out := make([]types.Presence, 0, len(friends))
+	for i := range friends {
+		out = append(out, p.presenceService.Presence(&friends[i]))
+	}
+	types.SuccessResponse(c, "Friends presence", out)
+}
+
+func (p *PresenceController) GetPrivacy(c *gin.Context) {
+	settings, err := p.userService.GetPrivacySettings(c, c.GetString("UserId"))
+	if err != nil {
+		types.FailResponse(c, http.StatusInternalServerError, "Failed to load privacy settings", err.Error())
+		return
+	}
+	types.SuccessResponse(c, "Privacy settings", settings)
+}
+
+func (p *PresenceController) UpdatePrivacy(c *gin.Context) {
+	var req types.PrivacySettings
+	if err := c.ShouldBindJSON(&req); err != nil {
+		types.FailResponse(c, http.StatusBadRequest, "Bad Request", err.Error())
+		return
+	}
+	if err := p.userService.UpdatePrivacySettings(c, c.GetString("UserId"), req); err != nil {
+		types.FailResponse(c, http.StatusInternalServerError, "Failed to update privacy settings", err.Error())
+		return
+	}
+	types.SuccessResponse(c, "Privacy settings updated", req)
+}
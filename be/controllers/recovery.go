@@ -0,0 +1,189 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/services"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/types"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/utils"
+)
+
+type RecoveryController struct {
+	userService         *services.UserService
+	authService         *services.AuthService
+	recoveryService     *services.RecoveryService
+	transparencyService *services.TransparencyService
+	socketController    *SocketController
+}
+
+func NewRecoveryController(us *services.UserService, as *services.AuthService, rs *services.RecoveryService, ts *services.TransparencyService, socketController *SocketController) *RecoveryController {
+	return &RecoveryController{userService: us, authService: as, recoveryService: rs, transparencyService: ts, socketController: socketController}
+}
+
+func (r *RecoveryController) SetupRecovery(c *gin.Context) {
+	var req types.RecoverySetupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		types.FailResponse(c, http.StatusBadRequest, "Bad Request", err.Error())
+		return
+	}
+
+	user, err := r.userService.GetUserByUsername(c, c.GetString("username"))
+	if err != nil {
+		types.FailResponse(c, http.StatusUnauthorized, "User not found", nil)
+		return
+	}
+
+	if _, err := r.recoveryService.SetupRecovery(c, user, req); err != nil {
+		types.FailResponse(c, http.StatusBadRequest, "Recovery setup rejected", err.Error())
+		return
+	}
+
+	info, err := r.recoveryService.GetRecoveryConfig(c, user.ID)
+	if err != nil {
+		types.FailResponse(c, http.StatusInternalServerError, "Failed to load recovery configuration", err.Error())
+		return
+	}
+	types.SuccessResponse(c, "Recovery configured", info)
+}
+
+func (r *RecoveryController) GetRecovery(c *gin.Context) {
+	info, err := r.recoveryService.GetRecoveryConfig(c, c.GetString("UserId"))
+	if errors.Is(err, services.ErrRecoveryNotConfigured) {
+		types.FailResponse(c, http.StatusNotFound, "Recovery not configured", nil)
+		return
+	}
+	if err != nil {
+		types.FailResponse(c, http.StatusInternalServerError, "Failed to load recovery configuration", err.Error())
+		return
+	}
+	types.SuccessResponse(c, "Recovery configuration", info)
+}
+
+func (r *RecoveryController) DeleteRecovery(c *gin.Context) {
+	if err := r.recoveryService.DeleteRecovery(c, c.GetString("UserId")); err != nil {
+		types.FailResponse(c, http.StatusInternalServerError, "Failed to remove recovery configuration", err.Error())
+		return
+	}
+	types.SuccessResponse(c, "Recovery removed", nil)
+}
+
+func (r *RecoveryController) ListGuardianRequests(c *gin.Context) {
+	requests, err := r.recoveryService.ListGuardianRequests(c, c.GetString("UserId"))
+	if err != nil {
+		types.FailResponse(c, http.StatusInternalServerError, "Failed to list recovery requests", err.Error())
+		return
+	}
+	types.SuccessResponse(c, "Pending recovery requests", requests)
+}
+
+func (r *RecoveryController) ApproveRecovery(c *gin.Context) {
+	var req types.RecoveryApproveRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		types.FailResponse(c, http.StatusBadRequest, "Bad Request", err.Error())
+		return
+	}
+
+	guardian, err := r.userService.GetUserByUsername(c, c.GetString("username"))
+	if err != nil {
+		types.FailResponse(c, http.StatusUnauthorized, "User not found", nil)
+		return
+	}
+
+	owner, err := r.recoveryService.ApproveRecovery(c, guardian, c.Param("id"), req)
+	switch {
+	case errors.Is(err, services.ErrRecoveryRequestNotFound), errors.Is(err, services.ErrRecoveryNotGuardian):
+		types.FailResponse(c, http.StatusNotFound, "Recovery request not found", nil)
+		return
+	case errors.Is(err, services.ErrRecoveryAlreadyApproved):
+		types.FailResponse(c, http.StatusConflict, "Recovery request already approved", nil)
+		return
+	case err != nil:
+		types.FailResponse(c, http.StatusBadRequest, "Approval rejected", err.Error())
+		return
+	}
+
+	r.socketController.SendRecoveryEvent(owner, "approved", c.Param("id"))
+	types.SuccessResponse(c, "Recovery approved", nil)
+}
+
+func (r *RecoveryController) StartRecovery(c *gin.Context) {
+	var req types.RecoveryStartRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		types.FailResponse(c, http.StatusBadRequest, "Bad Request", err.Error())
+		return
+	}
+	req.Username = utils.CanonicalUsername(req.Username)
+
+	resp, guardians, err := r.recoveryService.StartRecovery(c, req)
+	if errors.Is(err, services.ErrRecoveryNotConfigured) {
+		types.FailResponse(c, http.StatusNotFound, "Recovery not available for this account", nil)
+		return
+	}
+	if errors.Is(err, services.ErrRecoveryTooManyRequests) {
+		types.FailResponse(c, http.StatusTooManyRequests, "Too many open recovery requests", err.Error())
+		return
+	}
+	if err != nil {
+		types.FailResponse(c, http.StatusBadRequest, "Recovery request rejected", err.Error())
+		return
+	}
+
+	// the owner may still be signed in somewhere and should learn about the attempt
+	r.socketController.SendRecoveryEvent(req.Username, "requested", resp.RequestID)
+	for _, guardian := range guardians {
+		r.socketController.SendRecoveryEvent(guardian, "approval_needed", resp.RequestID)
+	}
+	types.SuccessResponse(c, "Recovery requested", resp)
+}
+
+func (r *RecoveryController) GetRecoveryStatus(c *gin.Context) {
+	var req types.RecoveryTokenRequest
+	if err := c.ShouldBindQuery(&req); err != nil || req.Token == "" {
+		types.FailResponse(c, http.StatusBadRequest, "Bad Request", "token is required")
+		return
+	}
+
+	status, err := r.recoveryService.RecoveryStatus(c, c.Param("id"), req.Token)
+	if errors.Is(err, services.ErrRecoveryRequestNotFound) {
+		types.FailResponse(c, http.StatusNotFound, "Recovery request not found", nil)
+		return
+	}
+	if err != nil {
+		types.FailResponse(c, http.StatusInternalServerError, "Failed to load recovery request", err.Error())
+		return
+	}
+	types.SuccessResponse(c, "Recovery status", status)
+}
+
+func (r *RecoveryController) CompleteRecovery(c *gin.Context) {
+	var req types.RecoveryTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Token == "" {
+		types.FailResponse(c, http.StatusBadRequest, "Bad Request", "token is required")
+		return
+	}
+
+	user, newKey, err := r.recoveryService.CompleteRecovery(c, c.Param("id"), req.Token)
+	switch {
+	case errors.Is(err, services.ErrRecoveryRequestNotFound):
+		types.FailResponse(c, http.StatusNotFound, "Recovery request not found", nil)
+		return
+	case errors.Is(err, services.ErrRecoveryThresholdNotMet):
+		types.FailResponse(c, http.StatusForbidden, "Not enough guardians approved the recovery", nil)
+		return
+	case err != nil:
+		types.FailResponse(c, http.StatusInternalServerError, "Failed to complete recovery", err.Error())
+		return
+	}
+
+	if err := r.authService.RevokeAllSessions(c, user.ID); err != nil {
+		log.Println("Failed to revoke sessions after recovery:", err)
+	}
+	if _, err := r.transparencyService.Append(c, user.Username, newKey); err != nil {
+		log.Println("Failed to append recovered key to key log:", err)
+	}
+
+	types.SuccessResponse(c, "Account recovered, log in with the new key", user.Username)
+}
@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/services"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/types"
+)
+
+type SessionController struct {
+	authService *services.AuthService
+}
+
+func NewSessionController(authService *services.AuthService) *SessionController {
+	return &SessionController{authService: authService}
+}
+
+func (s *SessionController) ListSessions(c *gin.Context) {
+	userID := c.GetString("UserId")
+	current := c.GetString("SessionId")
+
+	sessions, err := s.authService.ListSessions(c, userID)
+	if err != nil {
+		types.FailResponse(c, http.StatusInternalServerError, "Failed to list sessions", err.Error())
+		return
+	}
+
+	out := make([]types.SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		info := types.SessionInfo{
+			ID:        session.ID,
+			CreatedAt: session.CreatedAt.Format(time.RFC3339),
+			ExpiresAt: session.ExpiresAt.Format(time.RFC3339),
+			Current:   session.ID == current,
+		}
+		info.Name, _ = session.Name()
+		info.UserAgent, _ = session.UserAgent()
+		info.IPAddress, _ = session.IPAddress()
+		out = append(out, info)
+	}
+
+	types.SuccessResponse(c, "Active sessions", out)
+}
+
+func (s *SessionController) RenameSession(c *gin.Context) {
+	var req types.RenameSessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		types.FailResponse(c, http.StatusBadRequest, "Bad Request", err.Error())
+		return
+	}
+
+	err := s.authService.RenameSession(c, c.GetString("UserId"), c.Param("id"), req.Name)
+	if errors.Is(err, services.ErrSessionNotFound) {
+		types.FailResponse(c, http.StatusNotFound, "Session not found", nil)
+		return
+	}
+	if err != nil {
+		types.FailResponse(c, http.StatusInternalServerError, "Failed to rename session", err.Error())
+		return
+	}
+
+	types.SuccessResponse(c, "Session renamed", nil)
+}
+
+func (s *SessionController) RevokeSession(c *gin.Context) {
+	err := s.authService.RevokeSessionByID(c, c.GetString("UserId"), c.Param("id"))
+	if errors.Is(err, services.ErrSessionNotFound) {
+		types.FailResponse(c, http.StatusNotFound, "Session not found", nil)
+		return
+	}
+	if err != nil {
+		types.FailResponse(c, http.StatusInternalServerError, "Failed to revoke session", err.Error())
+		return
+	}
+
+	types.SuccessResponse(c, "Session revoked", nil)
+}
+
+func (s *SessionController) RevokeOtherSessions(c *gin.Context) {
+	current := c.GetString("SessionId")
+	if current == "" {
+		types.FailResponse(c, http.StatusBadRequest, "Current session unknown, please log in again", nil)
+		return
+	}
+
+	n, err := s.authService.RevokeOtherSessions(c, c.GetString("UserId"), current)
+	if err != nil {
+		types.FailResponse(c, http.StatusInternalServerError, "Failed to revoke sessions", err.Error())
+		return
+	}
+
+	types.SuccessResponse(c, "Other sessions revoked", gin.H{"revoked": n})
+}
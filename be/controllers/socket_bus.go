@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/types"
+)
+
+// sessionsChannel is the bus channel carrying session revocations, which every replica subscribes to.
+const sessionsChannel = "sessions"
+
+// userChannel is the bus channel carrying the socket events of username.
+func userChannel(username string) string {
+	return "user:" + username
+}
+
+// register adds client to the registry and subscribes this replica to the bus channel of
+// its user if it is the user's first connection here.
+func (s *SocketController) register(client *socketClient) {
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+
+	s.conns.add(client)
+	username := client.username
+	if _, ok := s.subs[username]; !ok {
+		s.subs[username] = s.bus.Subscribe(userChannel(username), func(payload []byte) {
+			s.applyEvent(username, payload)
+		})
+	}
+}
+
+// unregister drops client and unsubscribes from its user's channel once no connection of
+// that user is left here. It reports whether client was still registered.
+func (s *SocketController) unregister(client *socketClient) bool {
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+
+	removed := s.conns.remove(client)
+	if len(s.conns.forUser(client.username)) == 0 {
+		if unsubscribe, ok := s.subs[client.username]; ok {
+			unsubscribe()
+			delete(s.subs, client.username)
+		}
+	}
+	return removed
+}
+
+// publish sends event to the sockets of username on every replica.
+func (s *SocketController) publish(username string, event types.SocketEvent) {
+	s.publishTo(userChannel(username), event)
+}
+
+// publishTo sends event to the subscribers of a bus channel on every replica.
+func (s *SocketController) publishTo(channel string, event types.SocketEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode %s event for %s: %v", event.Kind, channel, err)
+		return
+	}
+	if err := s.bus.Publish(context.Background(), channel, data); err != nil {
+		log.Printf("Failed to publish %s event for %s: %v", event.Kind, channel, err)
+	}
+}
+
+// applyEvent applies an event from the bus to the sockets of username on this replica.
+func (s *SocketController) applyEvent(username string, data []byte) {
+	var event types.SocketEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		log.Printf("Dropping malformed socket event for %s: %v", username, err)
+		return
+	}
+
+	switch event.Kind {
+	case types.SocketEventFrame:
+		for _, client := range s.conns.forUser(username) {
+			_ = client.send(event.Frame, "", event.Payload)
+		}
+	case types.SocketEventMessage:
+		if event.Message != nil {
+			s.routeMessage(username, *event.Message, event.SkipConn)
+		}
+	case types.SocketEventClose:
+		clients := s.conns.forUser(username)
+		if event.DeviceID != "" {
+			clients = s.conns.forDevice(event.DeviceID)
+		}
+		s.closeClients(clients, event.CloseCode, event.Reason)
+	}
+}
+
+// applySessionsEvent closes the sockets of revoked sessions on this replica.
+func (s *SocketController) applySessionsEvent(data []byte) {
+	var event types.SocketEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		log.Printf("Dropping malformed sessions event: %v", err)
+		return
+	}
+	if event.Kind == types.SocketEventClose {
+		for _, id := range event.SessionIDs {
+			s.closeClients(s.conns.forSession(id), event.CloseCode, event.Reason)
+		}
+	}
+}
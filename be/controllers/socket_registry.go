@@ -0,0 +1,91 @@
+package controllers
+
+import "sync"
+
+// connRegistry indexes the open chat sockets of this server. A user can hold any number of
+// connections at once, e.g. one per tab, and so can a session or a device. Connections are
+// keyed by their own ID, so closing one never removes another.
+type connRegistry struct {
+	mu        sync.RWMutex
+	byUser    map[string]map[string]*socketClient // username -> connection ID -> client
+	bySession map[string]map[string]*socketClient
+	byDevice  map[string]map[string]*socketClient
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{
+		byUser:    make(map[string]map[string]*socketClient),
+		bySession: make(map[string]map[string]*socketClient),
+		byDevice:  make(map[string]map[string]*socketClient),
+	}
+}
+
+func addTo(index map[string]map[string]*socketClient, key string, c *socketClient) {
+	if key == "" {
+		return
+	}
+	set, ok := index[key]
+	if !ok {
+		set = make(map[string]*socketClient)
+		index[key] = set
+	}
+	set[c.id] = c
+}
+
+func removeFrom(index map[string]map[string]*socketClient, key string, c *socketClient) {
+	set, ok := index[key]
+	if !ok {
+		return
+	}
+	delete(set, c.id)
+	if len(set) == 0 {
+		delete(index, key)
+	}
+}
+
+func (r *connRegistry) add(c *socketClient) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	addTo(r.byUser, c.username, c)
+	addTo(r.bySession, c.sessionID, c)
+	addTo(r.byDevice, c.deviceID, c)
+}
+
+// remove drops c and reports whether it was still registered.
+func (r *connRegistry) remove(c *socketClient) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.byUser[c.username][c.id]; !ok {
+		return false
+	}
+	removeFrom(r.byUser, c.username, c)
+	removeFrom(r.bySession, c.sessionID, c)
+	removeFrom(r.byDevice, c.deviceID, c)
+	return true
+}
+
+func list(set map[string]*socketClient) []*socketClient {
+	out := make([]*socketClient, 0, len(set))
+	for _, c := range set {
+		out = append(out, c)
+	}
+	return out
+}
+
+func (r *connRegistry) forUser(username string) []*socketClient {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return list(r.byUser[username])
+}
+
+func (r *connRegistry) forSession(sessionID string) []*socketClient {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return list(r.bySession[sessionID])
+}
+
+func (r *connRegistry) forDevice(deviceID string) []*socketClient {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return list(r.byDevice[deviceID])
+}
@@ -0,0 +1,47 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/services"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/types"
+)
+
+type TransparencyController struct {
+	transparencyService *services.TransparencyService
+}
+
+func NewTransparencyController(ts *services.TransparencyService) *TransparencyController {
+	return &TransparencyController{transparencyService: ts}
+}
+
+func (t *TransparencyController) GetTreeHead(c *gin.Context) {
+	head, err := t.transparencyService.TreeHead(c)
+	if err != nil {
+		types.FailResponse(c, http.StatusInternalServerError, "Failed to build tree head", err.Error())
+		return
+	}
+	types.SuccessResponse(c, "Signed tree head", head)
+}
+
+func (t *TransparencyController) GetConsistencyProof(c *gin.Context) {
+	first, err := strconv.Atoi(c.Query("first"))
+	if err != nil {
+		types.FailResponse(c, http.StatusBadRequest, "Bad Request", "first must be a tree size")
+		return
+	}
+	second, err := strconv.Atoi(c.Query("second"))
+	if err != nil {
+		types.FailResponse(c, http.StatusBadRequest, "Bad Request", "second must be a tree size")
+		return
+	}
+
+	proof, err := t.transparencyService.ConsistencyProof(c, first, second)
+	if err != nil {
+		types.FailResponse(c, http.StatusBadRequest, "Failed to build consistency proof", err.Error())
+		return
+	}
+	types.SuccessResponse(c, "Consistency proof", proof)
+}
@@ -2,32 +2,53 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/services"
 	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/types"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/utils"
 )
 
 type UserController struct {
 	userService *services.UserService
 	chatService *services.ChatService
+	transparencyService *services.TransparencyService
 	socketController *SocketController
 }
 
-func NewUserController(us *services.UserService, cs *services.ChatService, socketController *SocketController) *UserController {
-	return &UserController{userService: us, chatService: cs, socketController: socketController}
+func NewUserController(us *services.UserService, cs *services.ChatService, ts *services.TransparencyService, socketController *SocketController) *UserController {
+	return &UserController{userService: us, chatService: cs, transparencyService: ts, socketController: socketController}
 }
 
 func (u *UserController) GetPublicKey(c *gin.Context) {
-	username := c.Param("username")
+	username := utils.CanonicalUsername(c.Param("username"))
 	client := u.userService
 	pk, err := client.GetPublicKey(c, username)
 	if err != nil {
 		c.JSON(http.StatusNotFound, types.IdentityPayload{Username: username, PublicKeyHex: types.PublicKey{X: "", Y: ""}})
 		return
 	}
-	c.JSON(http.StatusOK, types.IdentityPayload{Username: username, PublicKeyHex: pk})
+
+	resp := types.PublicKeyLookupResponse{Username: username, PublicKeyHex: pk}
+	if c.Query("history") == "true" {
+		history, err := client.GetKeyHistory(c, username)
+		if err != nil {
+			types.FailResponse(c, http.StatusInternalServerError, "Failed to load key history", err.Error())
+			return
+		}
+		resp.History = history
+	}
+
+	proof, err := u.transparencyService.InclusionProof(c, username, pk)
+	if err != nil {
+		types.FailResponse(c, http.StatusInternalServerError, "Failed to build key log inclusion proof", err.Error())
+		return
+	}
+	resp.Transparency = proof
+	c.JSON(http.StatusOK, resp)
 }
 
 func (u *UserController) ChatHistoryHandler(c *gin.Context) {
@@ -36,12 +57,12 @@ func (u *UserController) ChatHistoryHandler(c *gin.Context) {
 		c.Status(http.StatusUnauthorized)
 		return
 	}
-	to := c.Param("username_receiver")
+	to := utils.CanonicalUsername(c.Param("username_receiver"))
 	if to == "" {
 		c.JSON(http.StatusOK, []interface{}{})
 		return
 	}
-	list, err := u.chatService.ListHistory(context.Background(), me, to)
+	list, err := u.chatService.ListHistory(context.Background(), me, to, c.Query("device_id"))
 	if err != nil {
 		c.JSON(http.StatusOK, []interface{}{})
 		return
@@ -49,13 +70,75 @@ func (u *UserController) ChatHistoryHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, list)
 }
 
+// MarkConversationRead marks the messages the given user sent to the caller as read, up to
+// the message in the optional body, and tells the sender.
+func (u *UserController) MarkConversationRead(c *gin.Context) {
+	var req types.MarkReadRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			types.FailResponse(c, http.StatusBadRequest, "Bad Request", err.Error())
+			return
+		}
+	}
+	peer := utils.CanonicalUsername(c.Param("username"))
+
+	upTo, err := u.chatService.MarkReceipts(c, c.GetString("UserId"), peer, req.UpTo, types.ReceiptRead)
+	if errors.Is(err, services.ErrUnknownReceiver) {
+		types.FailResponse(c, http.StatusNotFound, "User not found", nil)
+		return
+	}
+	if errors.Is(err, services.ErrInvalidMessageID) {
+		types.FailResponse(c, http.StatusBadRequest, "Invalid message id", nil)
+		return
+	}
+	if err != nil {
+		types.FailResponse(c, http.StatusInternalServerError, "Failed to mark conversation read", err.Error())
+		return
+	}
+
+	if upTo != "" {
+		u.socketController.SendReceipt(peer, types.ReceiptRead, c.GetString("username"), upTo)
+	}
+	types.SuccessResponse(c, "Conversation marked read", types.MarkReadRequest{UpTo: upTo})
+}
+
+// ListReceipts returns the receipts of the caller's messages recorded after ?since=, so a
+// client that was offline can catch up.
+func (u *UserController) ListReceipts(c *gin.Context) {
+	since := time.Time{}
+	if raw := c.Query("since"); raw != "" {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			types.FailResponse(c, http.StatusBadRequest, "Invalid since", err.Error())
+			return
+		}
+		since = t
+	}
+
+	receipts, err := u.chatService.ReceiptsSince(c, c.GetString("UserId"), since)
+	if err != nil {
+		types.FailResponse(c, http.StatusInternalServerError, "Failed to load receipts", err.Error())
+		return
+	}
+	types.SuccessResponse(c, "Receipts", receipts)
+}
+
 func (u *UserController) CreateUser(c *gin.Context) {
 	var r types.IdentityPayload
 	if err := c.BindJSON(&r); err != nil || r.Username == "" || r.PublicKeyHex.X == "" || r.PublicKeyHex.Y == "" {
 		c.Status(http.StatusBadRequest)
 		return
 	}
-	user, err := u.userService.CreateUser(c, r.Username, r.PublicKeyHex)
+	username, err := utils.ValidateUsername(r.Username)
+	if err != nil {
+		types.FailResponse(c, http.StatusBadRequest, "Invalid username", err.Error())
+		return
+	}
+	if err := u.userService.CheckUsernameAvailable(c, username); err != nil {
+		c.Status(http.StatusConflict)
+		return
+	}
+	user, err := u.userService.CreateUser(c, username, r.PublicKeyHex)
 	if err != nil {
 		c.Status(http.StatusConflict)
 		return
@@ -68,7 +151,7 @@ func (u *UserController) CreateUser(c *gin.Context) {
 }
 
 func (u *UserController) GetAllMessagesByUser(c *gin.Context) {
-	username := c.Param("username")
+	username := utils.CanonicalUsername(c.Param("username"))
 	messages, err := u.userService.GetAllMessagesByUser(c, username)
 	if err != nil {
 		c.JSON(http.StatusNotFound, []interface{}{})
@@ -79,10 +162,19 @@ func (u *UserController) GetAllMessagesByUser(c *gin.Context) {
 
 func (u *UserController) AddFriendHandler(c *gin.Context) {
 	var r types.FriendRequestPayload
-	if err := c.BindJSON(&r); err != nil || r.Username == "" || r.FriendUsername == "" {
+	if err := c.BindJSON(&r); err != nil || r.FriendUsername == "" {
 		c.Status(http.StatusBadRequest)
 		return
 	}
+	// the friendship is always added for the authenticated user, the username in the body
+	// is only kept for older clients and has to name that user
+	username := c.GetString("username")
+	if r.Username != "" && utils.CanonicalUsername(r.Username) != username {
+		types.FailResponse(c, http.StatusForbidden, "Cannot add friends for another user", nil)
+		return
+	}
+	r.Username = username
+	r.FriendUsername = utils.CanonicalUsername(r.FriendUsername)
 
 	friendship, err := u.userService.AddFriend(c, r.Username, r.FriendUsername)
 	if err != nil {
@@ -100,12 +192,16 @@ func (u *UserController) AddFriendHandler(c *gin.Context) {
 	})
 }
 func (u *UserController) DeleteFriendHandler(c *gin.Context) {
-	username := c.Param("username")
-	friendUsername := c.Param("friend_username")
-	if username == "" || friendUsername == "" {
+	username := c.GetString("username")
+	friendUsername := utils.CanonicalUsername(c.Param("friend_username"))
+	if friendUsername == "" {
 		c.Status(http.StatusBadRequest)
 		return
 	}
+	if utils.CanonicalUsername(c.Param("username")) != username {
+		types.FailResponse(c, http.StatusForbidden, "Cannot remove friends of another user", nil)
+		return
+	}
 
 	err := u.userService.DeleteFriend(c, username, friendUsername)
 	if err != nil {
@@ -118,7 +214,7 @@ func (u *UserController) DeleteFriendHandler(c *gin.Context) {
 }
 
 func (u *UserController) GetFriendsHandler(c *gin.Context) {
-	username := c.Param("username")
+	username := utils.CanonicalUsername(c.Param("username"))
 	friends, err := u.userService.GetFriends(c, username)
 	if err != nil {
 		types.FailResponse(c, http.StatusInternalServerError, err.Error(), err.Error())
@@ -1,18 +1,29 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/controllers"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/middleware"
 	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/services"
 	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/utils"
 )
 
 func main() {
+  migrateUsernames := flag.Bool("migrate-usernames", false, "rename users to their canonical username, report conflicts and exit")
+  flag.Parse()
+
   utils.LoadEnv()
+  if err := middleware.LoadJWTKeys(os.Getenv("JWT_KEYS_DIR"), os.Getenv("JWT_SIGNING_KID"), os.Getenv("JWT_EPHEMERAL_KEYS") == "true"); err != nil {
+      log.Fatalf("Failed to load JWT keys: %v", err)
+  }
   client := services.GetDB()
   quit := make(chan os.Signal, 1)
   signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -26,19 +37,89 @@ func main() {
       os.Exit(0)
   }()
 
-  userService := services.NewUserService(client)
-  chatService := services.NewChatService(client)
-  authService := services.NewAuthService(client)
-  authController := controllers.NewAuthController(userService, authService)
-  socketController := controllers.NewSocketController(userService, chatService)
-  userController := controllers.NewUserController(userService, chatService, socketController)
+  auditService := services.NewAuditService(client)
+  userService := services.NewUserService(client, auditService)
+  if *migrateUsernames {
+      code := runUsernameMigration(userService)
+      _ = client.Prisma.Disconnect()
+      os.Exit(code)
+  }
+  if err := userService.BackfillUsernameSkeletons(context.Background()); err != nil {
+      log.Println("Failed to backfill username skeletons:", err)
+  }
+  var nonceStore services.NonceStore = services.NewMemoryNonceStore()
+  var lockout services.LoginLockout = services.NewMemoryLoginLockout()
+  if os.Getenv("NONCE_STORE") == "postgres" {
+      nonceStore = services.NewPostgresNonceStore(client)
+      lockout = services.NewPostgresLoginLockout(client)
+  }
+  go services.RunNonceJanitor(context.Background(), nonceStore, time.Minute)
+  go services.RunLockoutJanitor(context.Background(), lockout, time.Minute)
+
+  logKey, err := services.LoadLogSigningKey(os.Getenv("TRANSPARENCY_KEY_FILE"))
+  if err != nil {
+      log.Fatalf("Failed to load transparency log key: %v", err)
+  }
+
+  authService := services.NewAuthService(client, nonceStore, lockout, auditService)
+  chatService := services.NewChatService(client, authService)
+  transparencyService := services.NewTransparencyService(client, logKey)
+  if err := transparencyService.BackfillKeyLog(context.Background()); err != nil {
+      log.Println("Failed to backfill key log:", err)
+  }
+  deviceService := services.NewDeviceService(client, authService, nonceStore, auditService)
+  recoveryService := services.NewRecoveryService(client, authService, auditService)
+  authController := controllers.NewAuthController(userService, authService, transparencyService)
+  presenceService := services.NewPresenceService(client)
+  var bus services.Bus = services.NewMemoryBus()
+  if os.Getenv("MESSAGE_BUS") == "postgres" {
+      pgBus := services.NewPostgresBus(client, os.Getenv("DATABASE_URL"))
+      go pgBus.Listen(context.Background())
+      go services.RunBusJanitor(context.Background(), pgBus, time.Minute)
+      bus = pgBus
+  }
+  socketController := controllers.NewSocketController(userService, chatService, deviceService, authService, presenceService, bus)
+  authService.OnSessionsRevoked(middleware.Revocations.Revoke)
+  authService.OnSessionsRevoked(socketController.CloseSessions)
+  authService.OnDeviceRevoked(socketController.CloseDevice)
+  go services.RunRevocationSync(context.Background(), authService, middleware.Revocations.IsRevoked, 5*time.Second)
+  authService.OnRefreshTokenReuse(socketController.SendSecurityAlert)
+  sessionController := controllers.NewSessionController(authService)
+  userController := controllers.NewUserController(userService, chatService, transparencyService, socketController)
   chatController := controllers.NewChatController(chatService)
+  transparencyController := controllers.NewTransparencyController(transparencyService)
+  deviceController := controllers.NewDeviceController(userService, deviceService, socketController)
+  accountController := controllers.NewAccountController(userService, authService, transparencyService, socketController)
+  recoveryController := controllers.NewRecoveryController(userService, authService, recoveryService, transparencyService, socketController)
+  auditController := controllers.NewAuditController(auditService)
+  presenceController := controllers.NewPresenceController(userService, presenceService)
 
   port := os.Getenv("PORT")
   if port == "" {
       port = "8080"
   }
 
-  router := SetupRouter(authController,socketController,userController, chatController)
+  router := SetupRouter(authController,socketController,userController, chatController, transparencyController, sessionController, deviceController, accountController, recoveryController, auditController, presenceController)
   router.Run(":" + port)
-}
\ No newline at end of file
+}
+
+// runUsernameMigration renames users to their canonical username once and prints what it did.
+// It exits non-zero when a username could not be renamed, so the conflict is not missed.
+func runUsernameMigration(userService *services.UserService) int {
+  report, err := userService.MigrateUsernames(context.Background())
+  for from, to := range report.Renamed {
+      fmt.Printf("renamed %q to %q, sessions revoked\n", from, to)
+  }
+  for _, username := range report.Conflicts {
+      fmt.Printf("conflict: %q not renamed, its canonical form is claimed by another user\n", username)
+  }
+  if err != nil {
+      fmt.Fprintln(os.Stderr, "Failed to migrate usernames:", err)
+      return 1
+  }
+  fmt.Printf("%d renamed, %d conflicts\n", len(report.Renamed), len(report.Conflicts))
+  if len(report.Conflicts) > 0 {
+      return 1
+  }
+  return 0
+}
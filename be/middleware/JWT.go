@@ -5,20 +5,26 @@ import (
 	"net/http"
 	"strings"
 	"time"
-	"os"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/types"
 )
 
-var (
-	accessSecret  = []byte(os.Getenv("ACCESS_TOKEN_SECRET"))  
-	refreshSecret = []byte(os.Getenv("REFRESH_TOKEN_SECRET")) 
+// Access and refresh tokens are signed with the same keys, the audience keeps one
+// from being accepted as the other.
+const (
+	accessTokenAudience  = "access"
+	refreshTokenAudience = "refresh"
+	wsTicketAudience     = "ws-ticket"
 )
 
+var validMethods = []string{jwt.SigningMethodES256.Alg(), jwt.SigningMethodEdDSA.Alg()}
+
 type AccessTokenClaims struct {
-	Username string `json:"username"`
+	Username  string `json:"username"`
+	SessionID string `json:"sid"`
 	jwt.RegisteredClaims
 }
 
@@ -28,6 +34,17 @@ type RefreshTokenClaims struct {
 	jwt.RegisteredClaims
 }
 
+// WSTicketClaims authorize a single chat socket upgrade from the IP they were issued to.
+type WSTicketClaims struct {
+	Username  string `json:"username"`
+	SessionID string `json:"sid"`
+	IPAddress string `json:"ip"`
+	// TokenExpiresAt is when the access token the ticket was issued for expires, the
+	// socket has to re-authenticate by then.
+	TokenExpiresAt int64 `json:"token_exp"`
+	jwt.RegisteredClaims
+}
+
 func JWTAuth() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		auth := ctx.GetHeader("Authorization")
@@ -46,48 +63,100 @@ func JWTAuth() gin.HandlerFunc {
 			ctx.Abort()
 			return
 		}
+		if !Revocations.CheckAccessToken(claims) {
+			types.FailResponse(ctx, http.StatusUnauthorized, "Session has been revoked", nil)
+			ctx.Abort()
+			return
+		}
 
 		ctx.Set("username", claims.Username)
 		ctx.Set("UserId", claims.Subject)
+		ctx.Set("SessionId", claims.SessionID)
+		ctx.Set("TokenId", claims.ID)
+		ctx.Set("TokenExpiresAt", claims.ExpiresAt.Time)
 
 		ctx.Next()
 	}
 }
 
-func GenerateAccessToken(userID, username string) (string, error) {
+func GenerateAccessToken(userID, username, sessionID string) (string, error) {
 	now := time.Now()
 	claims := AccessTokenClaims{
-		Username: username,
+		Username:  username,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
 			Subject:   userID,
+			Audience:  jwt.ClaimStrings{accessTokenAudience},
 			IssuedAt:  jwt.NewNumericDate(now),
 			ExpiresAt: jwt.NewNumericDate(now.Add(types.EXPIRATION_ACCESS_TOKEN)),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(accessSecret)
+	return signToken(claims)
 }
 
-func GenerateRefreshToken(sessionID, username string) (string, error) {
+// GenerateRefreshToken issues a refresh token for the session. It expires with the session,
+// rotating the token does not extend it.
+func GenerateRefreshToken(sessionID, username string, expiresAt time.Time) (string, error) {
 	now := time.Now()
 	claims := RefreshTokenClaims{
 		Username:  username,
 		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Audience:  jwt.ClaimStrings{refreshTokenAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+
+	return signToken(claims)
+}
+
+func GenerateWSTicket(userID, username, sessionID, ip string, tokenExpiresAt time.Time) (string, *WSTicketClaims, error) {
+	now := time.Now()
+	claims := &WSTicketClaims{
+		Username:       username,
+		SessionID:      sessionID,
+		IPAddress:      ip,
+		TokenExpiresAt: tokenExpiresAt.Unix(),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Subject:   userID,
+			Audience:  jwt.ClaimStrings{wsTicketAudience},
 			IssuedAt:  jwt.NewNumericDate(now),
-			ExpiresAt: jwt.NewNumericDate(now.Add(types.EXPIRATION_REFRESH_TOKEN)),
+			ExpiresAt: jwt.NewNumericDate(now.Add(types.EXPIRATION_WS_TICKET)),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(refreshSecret)
+	ticket, err := signToken(claims)
+	return ticket, claims, err
+}
+
+// VerifyWSTicket only checks the signature and expiry, single use is enforced by the caller.
+func VerifyWSTicket(ticket string) (*WSTicketClaims, error) {
+	token, err := jwt.ParseWithClaims(ticket, &WSTicketClaims{}, keyByKid,
+		jwt.WithValidMethods(validMethods),
+		jwt.WithAudience(wsTicketAudience),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(*WSTicketClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid websocket ticket")
+	}
+
+	return claims, nil
 }
 
 func VerifyAccessToken(tokenStr string) (*AccessTokenClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenStr, &AccessTokenClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return accessSecret, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenStr, &AccessTokenClaims{}, keyByKid,
+		jwt.WithValidMethods(validMethods),
+		jwt.WithAudience(accessTokenAudience),
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -101,9 +170,10 @@ func VerifyAccessToken(tokenStr string) (*AccessTokenClaims, error) {
 }
 
 func VerifyRefreshToken(tokenStr string) (*RefreshTokenClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenStr, &RefreshTokenClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return refreshSecret, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenStr, &RefreshTokenClaims{}, keyByKid,
+		jwt.WithValidMethods(validMethods),
+		jwt.WithAudience(refreshTokenAudience),
+	)
 	if err != nil {
 		return nil, err
 	}
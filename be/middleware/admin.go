@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/types"
+)
+
+// RequireAdmin only lets through users listed in ADMIN_USER_IDS. User IDs are used rather
+// than usernames since a username can be registered again after its account is deleted.
+// Must run after JWTAuth.
+func RequireAdmin() gin.HandlerFunc {
+	admins := make(map[string]bool)
+	for _, id := range strings.Split(os.Getenv("ADMIN_USER_IDS"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			admins[id] = true
+		}
+	}
+
+	return func(ctx *gin.Context) {
+		if !admins[ctx.GetString("UserId")] {
+			types.FailResponse(ctx, http.StatusForbidden, "Admin access required", nil)
+			ctx.Abort()
+			return
+		}
+		ctx.Next()
+	}
+}
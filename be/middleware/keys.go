@@ -0,0 +1,202 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwtKey is one key of the JWT key set. Keys without a private half can only verify,
+// which is how retired signing keys are kept around until the tokens they signed expire.
+type jwtKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+}
+
+var (
+	keysMu     sync.RWMutex
+	signingKey *jwtKey
+	verifyKeys = map[string]*jwtKey{}
+)
+
+// LoadJWTKeys reads every *.pem file in dir into the verification key set, using the file
+// name without extension as the kid, and signs new tokens with the key named activeKID.
+// A directory is required unless allowEphemeral is set, then a key is generated that only
+// lives as long as the process: tokens break on restart and are not valid on other replicas.
+func LoadJWTKeys(dir, activeKID string, allowEphemeral bool) error {
+	keys := map[string]*jwtKey{}
+
+	if dir == "" && !allowEphemeral {
+		return fmt.Errorf("JWT_KEYS_DIR is not set")
+	}
+	if dir == "" {
+		log.Println("WARNING: JWT_KEYS_DIR not set and JWT_EPHEMERAL_KEYS enabled, signing tokens with an ephemeral key.")
+		log.Println("WARNING: tokens stop working on restart and are rejected by other replicas, never use this in production.")
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		activeKID = "ephemeral"
+		keys[activeKID] = &jwtKey{kid: activeKID, method: jwt.SigningMethodES256, private: priv, public: &priv.PublicKey}
+	} else {
+		files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			kid := strings.TrimSuffix(filepath.Base(file), ".pem")
+			key, err := readJWTKey(file, kid)
+			if err != nil {
+				return fmt.Errorf("failed to load JWT key %s: %w", file, err)
+			}
+			keys[kid] = key
+		}
+	}
+
+	active, ok := keys[activeKID]
+	if !ok {
+		return fmt.Errorf("signing key %q not found", activeKID)
+	}
+	if active.private == nil {
+		return fmt.Errorf("signing key %q has no private key", activeKID)
+	}
+
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	signingKey = active
+	verifyKeys = keys
+	return nil
+}
+
+func readJWTKey(path, kid string) (*jwtKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := parsed.(type) {
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("only P-256 ECDSA keys are supported")
+		}
+		return &jwtKey{kid: kid, method: jwt.SigningMethodES256, private: k, public: &k.PublicKey}, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("only P-256 ECDSA keys are supported")
+		}
+		return &jwtKey{kid: kid, method: jwt.SigningMethodES256, public: k}, nil
+	case ed25519.PrivateKey:
+		return &jwtKey{kid: kid, method: jwt.SigningMethodEdDSA, private: k, public: k.Public()}, nil
+	case ed25519.PublicKey:
+		return &jwtKey{kid: kid, method: jwt.SigningMethodEdDSA, public: k}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", parsed)
+}
+
+func signToken(claims jwt.Claims) (string, error) {
+	keysMu.RLock()
+	key := signingKey
+	keysMu.RUnlock()
+	if key == nil {
+		return "", fmt.Errorf("JWT keys are not loaded")
+	}
+
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
+
+// keyByKid is the jwt.Keyfunc that picks the verification key named in the token header.
+func keyByKid(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	keysMu.RLock()
+	key, ok := verifyKeys[kid]
+	keysMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s for key %q", token.Method.Alg(), kid)
+	}
+	return key.public, nil
+}
+
+// PublicJWKS returns the public halves of all verification keys in JWK form.
+func PublicJWKS() []JWK {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+
+	enc := base64.RawURLEncoding
+	out := make([]JWK, 0, len(verifyKeys))
+	for _, key := range verifyKeys {
+		switch pub := key.public.(type) {
+		case *ecdsa.PublicKey:
+			out = append(out, JWK{
+				Kty: "EC",
+				Crv: "P-256",
+				X:   enc.EncodeToString(pub.X.FillBytes(make([]byte, 32))),
+				Y:   enc.EncodeToString(pub.Y.FillBytes(make([]byte, 32))),
+				Kid: key.kid,
+				Use: "sig",
+				Alg: key.method.Alg(),
+			})
+		case ed25519.PublicKey:
+			out = append(out, JWK{
+				Kty: "OKP",
+				Crv: "Ed25519",
+				X:   enc.EncodeToString(pub),
+				Kid: key.kid,
+				Use: "sig",
+				Alg: key.method.Alg(),
+			})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Kid < out[j].Kid })
+	return out
+}
@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/types"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/utils"
+)
+
+// RateLimitKey picks the bucket a request is counted against. An empty key skips the check.
+type RateLimitKey func(c *gin.Context) string
+
+func ByIP(c *gin.Context) string {
+	return "ip:" + c.ClientIP()
+}
+
+// ByUserID only works behind JWTAuth, which puts the user ID in the context.
+func ByUserID(c *gin.Context) string {
+	if id := c.GetString("UserId"); id != "" {
+		return "user:" + id
+	}
+	return ""
+}
+
+// ByUsername reads the username from the query string or, for JSON requests, the body.
+// The body is put back so the handler can still bind it.
+func ByUsername(c *gin.Context) string {
+	if username := c.Query("username"); username != "" {
+		return "username:" + utils.CanonicalUsername(username)
+	}
+	if c.Request.Body == nil || c.ContentType() != gin.MIMEJSON {
+		return ""
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+	if err != nil {
+		return ""
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	var payload struct {
+		Username string `json:"username"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil || payload.Username == "" {
+		return ""
+	}
+	return "username:" + utils.CanonicalUsername(payload.Username)
+}
+
+// RateLimit allows limit requests every per, with bursts of up to burst, for every key
+// the request maps to. Each call builds its own buckets, so routes are limited independently.
+func RateLimit(limit int, per time.Duration, burst int, keys ...RateLimitKey) gin.HandlerFunc {
+	limiter := utils.NewRateLimiter(limit, per, burst)
+
+	return func(c *gin.Context) {
+		for _, key := range keys {
+			k := key(c)
+			if k == "" {
+				continue
+			}
+			if ok, wait := limiter.Allow(k); !ok {
+				types.TooManyRequestsResponse(c, "Too many requests", wait)
+				c.Abort()
+				return
+			}
+		}
+		c.Next()
+	}
+}
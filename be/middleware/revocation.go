@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/types"
+)
+
+// RevocationCache remembers revoked sessions and access token IDs until every access token
+// they could apply to has expired, so checking a token needs no database round trip.
+type RevocationCache struct {
+	mu      sync.RWMutex
+	revoked map[string]time.Time
+}
+
+func NewRevocationCache() *RevocationCache {
+	return &RevocationCache{revoked: make(map[string]time.Time)}
+}
+
+// Revocations is consulted by JWTAuth and the chat socket for every access token.
+var Revocations = NewRevocationCache()
+
+// Revoke marks session or token IDs as revoked. Entries are kept for the lifetime of an
+// access token, after that no token bound to them can still be valid.
+func (rc *RevocationCache) Revoke(ids ...string) {
+	until := time.Now().Add(types.EXPIRATION_ACCESS_TOKEN)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for _, id := range ids {
+		if id != "" {
+			rc.revoked[id] = until
+		}
+	}
+	for id, exp := range rc.revoked {
+		if time.Now().After(exp) {
+			delete(rc.revoked, id)
+		}
+	}
+}
+
+func (rc *RevocationCache) IsRevoked(id string) bool {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	_, ok := rc.revoked[id]
+	return ok
+}
+
+// CheckAccessToken reports whether claims belong to a live session and were not revoked
+// on their own.
+func (rc *RevocationCache) CheckAccessToken(claims *AccessTokenClaims) bool {
+	if claims.SessionID == "" {
+		return false
+	}
+	return !rc.IsRevoked(claims.SessionID) && !rc.IsRevoked(claims.ID)
+}
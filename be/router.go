@@ -1,6 +1,11 @@
 package main
 
 import (
+	"log"
+	"os"
+	"strings"
+	"time"
+
 	"github.com/gin-gonic/gin"
 	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/controllers"
 	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/middleware"
@@ -11,24 +16,55 @@ func SetupRouter(
 	socketController *controllers.SocketController,
 	userController *controllers.UserController,
 	chatController *controllers.ChatController,
+	transparencyController *controllers.TransparencyController,
+	sessionController *controllers.SessionController,
+	deviceController *controllers.DeviceController,
+	accountController *controllers.AccountController,
+	recoveryController *controllers.RecoveryController,
+	auditController *controllers.AuditController,
+	presenceController *controllers.PresenceController,
 ) *gin.Engine {
 	router := gin.Default()
+	// ClientIP keys rate limits, sessions and socket tickets, so X-Forwarded-For is only
+	// honoured when the request comes from one of these proxies
+	if err := router.SetTrustedProxies(trustedProxies()); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
 
 	router.Use(middleware.CORS())
 
 	router.GET("/health-check", func(ctx *gin.Context) { ctx.JSON(200, gin.H{"status": "oke"}) })
+	router.GET("/.well-known/jwks.json", func(ctx *gin.Context) { ctx.JSON(200, gin.H{"keys": middleware.PublicJWKS()}) })
+
+	// per-route limits, each keyed by client IP and, where known, the username it targets
+	loginLimit := middleware.RateLimit(10, time.Minute, 10, middleware.ByIP, middleware.ByUsername)
+	nonceLimit := middleware.RateLimit(20, time.Minute, 10, middleware.ByIP, middleware.ByUsername)
+	registerChallengeLimit := middleware.RateLimit(5, time.Minute, 5, middleware.ByIP)
+	registerLimit := middleware.RateLimit(5, time.Minute, 5, middleware.ByIP)
+	refreshLimit := middleware.RateLimit(30, time.Minute, 10, middleware.ByIP)
+	socketLimit := middleware.RateLimit(10, time.Minute, 5, middleware.ByIP)
+	recoveryStartLimit := middleware.RateLimit(10, time.Minute, 5, middleware.ByIP, middleware.ByUsername)
+	recoveryStatusLimit := middleware.RateLimit(30, time.Minute, 10, middleware.ByIP)
+	recoveryCompleteLimit := middleware.RateLimit(10, time.Minute, 5, middleware.ByIP)
+	apiLimit := middleware.RateLimit(300, time.Minute, 60, middleware.ByUserID)
 
 	authGroup := router.Group("/api")
 	{
-		authGroup.POST("/login", authController.Login)
-		authGroup.GET("/nonce", authController.ReqChallenge)
-		authGroup.POST("/register", authController.Register)
-		authGroup.GET("/refresh", authController.RefreshToken)
-		authGroup.GET("/ws/chat", socketController.ChatWS)
+		authGroup.POST("/login", loginLimit, authController.Login)
+		authGroup.GET("/nonce", nonceLimit, authController.ReqChallenge)
+		authGroup.GET("/register/challenge", registerChallengeLimit, authController.ReqRegisterChallenge)
+		authGroup.POST("/register", registerLimit, authController.Register)
+		authGroup.GET("/refresh", refreshLimit, authController.RefreshToken)
+		authGroup.GET("/ws/chat", socketLimit, socketController.ChatWS)
+		authGroup.POST("/recovery/requests", recoveryStartLimit, recoveryController.StartRecovery)
+		authGroup.GET("/recovery/requests/:id", recoveryStatusLimit, recoveryController.GetRecoveryStatus)
+		authGroup.POST("/recovery/requests/:id/complete", recoveryCompleteLimit, recoveryController.CompleteRecovery)
+		authGroup.GET("/transparency/sth", transparencyController.GetTreeHead)
+		authGroup.GET("/transparency/consistency", transparencyController.GetConsistencyProof)
 	}
 
 	protected := authGroup.Group("/protected")
-	protected.Use(middleware.JWTAuth())
+	protected.Use(middleware.JWTAuth(), apiLimit)
 	{
 		protected.POST("/logout", authController.Logout)
 		protected.GET("/profile", func(ctx *gin.Context) {
@@ -40,12 +76,53 @@ func SetupRouter(
 			ctx.JSON(200, gin.H{"profile": claims})
 		})
 		protected.GET("/chat/metadata", chatController.GetChatMetadata)
+		protected.POST("/ws/ticket", socketController.IssueTicket)
 		protected.GET("/history/:username_receiver", userController.ChatHistoryHandler)
+		protected.POST("/conversations/:username/read", userController.MarkConversationRead)
+		protected.GET("/receipts", userController.ListReceipts)
 		protected.GET("/users/:username/public-key", userController.GetPublicKey)
+		protected.GET("/users/:username/devices", deviceController.ListUserDevices)
+		protected.GET("/devices/challenge", deviceController.ReqDeviceChallenge)
+		protected.POST("/devices", deviceController.RegisterDevice)
+		protected.GET("/devices", deviceController.ListMyDevices)
+		protected.DELETE("/devices/:id", deviceController.RevokeDevice)
+		protected.POST("/keys/rotate", authController.RotateKeys)
+		protected.DELETE("/account", accountController.DeleteAccount)
+		protected.GET("/recovery", recoveryController.GetRecovery)
+		protected.PUT("/recovery", recoveryController.SetupRecovery)
+		protected.DELETE("/recovery", recoveryController.DeleteRecovery)
+		protected.GET("/recovery/guardian/requests", recoveryController.ListGuardianRequests)
+		protected.POST("/recovery/requests/:id/approve", recoveryController.ApproveRecovery)
+		protected.GET("/sessions", sessionController.ListSessions)
+		protected.PATCH("/sessions/:id", sessionController.RenameSession)
+		protected.DELETE("/sessions/:id", sessionController.RevokeSession)
+		protected.DELETE("/sessions", sessionController.RevokeOtherSessions)
 		protected.GET("/friends/:username", userController.GetFriendsHandler)
 		protected.POST("/friends/add", userController.AddFriendHandler)
 		protected.DELETE("/friends/delete/:username/:friend_username", userController.DeleteFriendHandler)
+		protected.GET("/security/activity", auditController.SecurityActivity)
+		protected.GET("/presence", presenceController.FriendsPresence)
+		protected.GET("/settings/privacy", presenceController.GetPrivacy)
+		protected.PUT("/settings/privacy", presenceController.UpdatePrivacy)
+	}
+
+	admin := protected.Group("/admin")
+	admin.Use(middleware.RequireAdmin())
+	{
+		admin.GET("/audit", auditController.QueryEvents)
+		admin.GET("/audit/verify", auditController.VerifyChain)
 	}
 
 	return router
 }
+
+// trustedProxies reads TRUSTED_PROXIES, a comma separated list of IPs or CIDRs. Empty trusts no proxy.
+func trustedProxies() []string {
+	var proxies []string
+	for _, p := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			proxies = append(proxies, p)
+		}
+	}
+	return proxies
+}
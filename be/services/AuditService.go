@@ -0,0 +1,232 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/prisma/db"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/types"
+)
+
+// auditGenesisHash is the previous hash of the first audit event.
+var auditGenesisHash = strings.Repeat("0", 64)
+
+// AuditService writes security events to a hash chained log.
+type AuditService struct {
+	prismaClient *db.PrismaClient
+	mu           sync.Mutex
+}
+
+func NewAuditService(client *db.PrismaClient) *AuditService {
+	return &AuditService{prismaClient: client}
+}
+
+// auditHash hashes an event together with the hash of its predecessor. The fields are
+// JSON encoded so values containing separators can not be shifted between fields.
+func auditHash(e *db.AuditEventModel) string {
+	userID, _ := e.UserID()
+	username, _ := e.Username()
+	ip, _ := e.IPAddress()
+	userAgent, _ := e.UserAgent()
+	encoded, _ := json.Marshal([]interface{}{
+		e.Seq, e.EventType, userID, username, ip, userAgent, e.Details, e.CreatedAt.UnixMilli(), e.PrevHash,
+	})
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+// Record appends an event. When ctx is a request context the client IP and user agent are
+// stored with it. Failures are logged, a missing audit record never fails the request.
+func (as *AuditService) Record(ctx context.Context, eventType, userID, username string, details map[string]interface{}) {
+	if err := as.record(ctx, eventType, userID, username, details); err != nil {
+		log.Printf("Failed to record audit event %s: %v", eventType, err)
+	}
+}
+
+func (as *AuditService) record(ctx context.Context, eventType, userID, username string, details map[string]interface{}) error {
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	encoded, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+
+	event := db.AuditEventModel{InnerAuditEvent: db.InnerAuditEvent{
+		EventType: eventType,
+		Details:   string(encoded),
+	}}
+	params := []db.AuditEventSetParam{}
+	if userID != "" {
+		event.InnerAuditEvent.UserID = &userID
+		params = append(params, db.AuditEvent.UserID.Set(userID))
+	}
+	if username != "" {
+		event.InnerAuditEvent.Username = &username
+		params = append(params, db.AuditEvent.Username.Set(username))
+	}
+	if c, ok := ctx.(*gin.Context); ok && c.Request != nil {
+		ip, userAgent := c.ClientIP(), c.Request.UserAgent()
+		event.InnerAuditEvent.IPAddress = &ip
+		event.InnerAuditEvent.UserAgent = &userAgent
+		params = append(params, db.AuditEvent.IPAddress.Set(ip), db.AuditEvent.UserAgent.Set(userAgent))
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	for attempt := 0; attempt < 3; attempt++ {
+		event.Seq, event.PrevHash = 0, auditGenesisHash
+		last, err := as.prismaClient.AuditEvent.FindFirst().OrderBy(
+			db.AuditEvent.Seq.Order(db.SortOrderDesc),
+		).Exec(ctx)
+		if err == nil {
+			event.Seq, event.PrevHash = last.Seq+1, last.Hash
+		} else if !errors.Is(err, db.ErrNotFound) {
+			return err
+		}
+		// Postgres keeps milliseconds, the hash has to match what is read back
+		event.CreatedAt = time.Now().Truncate(time.Millisecond)
+		event.Hash = auditHash(&event)
+
+		_, err = as.prismaClient.AuditEvent.CreateOne(
+			db.AuditEvent.Seq.Set(event.Seq),
+			db.AuditEvent.EventType.Set(event.EventType),
+			db.AuditEvent.Details.Set(event.Details),
+			db.AuditEvent.CreatedAt.Set(event.CreatedAt),
+			db.AuditEvent.PrevHash.Set(event.PrevHash),
+			db.AuditEvent.Hash.Set(event.Hash),
+			params...,
+		).Exec(ctx)
+		if _, ok := db.IsErrUniqueConstraint(err); ok {
+			// another replica took this sequence number, chain onto its event instead
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("failed to append audit event after concurrent writes")
+}
+
+func auditEventFromModel(e *db.AuditEventModel) types.AuditEvent {
+	event := types.AuditEvent{
+		Seq:       e.Seq,
+		Type:      e.EventType,
+		CreatedAt: e.CreatedAt.Format(time.RFC3339),
+		PrevHash:  e.PrevHash,
+		Hash:      e.Hash,
+	}
+	event.UserID, _ = e.UserID()
+	event.Username, _ = e.Username()
+	event.IPAddress, _ = e.IPAddress()
+	event.UserAgent, _ = e.UserAgent()
+	_ = json.Unmarshal([]byte(e.Details), &event.Details)
+	return event
+}
+
+// Query returns the newest events matching q.
+func (as *AuditService) Query(ctx context.Context, q types.AuditQuery) ([]types.AuditEvent, error) {
+	params := []db.AuditEventWhereParam{}
+	if q.Type != "" {
+		params = append(params, db.AuditEvent.EventType.Equals(q.Type))
+	}
+	if q.UserID != "" {
+		params = append(params, db.AuditEvent.UserID.Equals(q.UserID))
+	}
+	if q.Username != "" {
+		params = append(params, db.AuditEvent.Username.Equals(q.Username))
+	}
+	if q.IPAddress != "" {
+		params = append(params, db.AuditEvent.IPAddress.Equals(q.IPAddress))
+	}
+	if q.From != "" {
+		from, err := time.Parse(time.RFC3339, q.From)
+		if err != nil {
+			return nil, fmt.Errorf("invalid from: %w", err)
+		}
+		params = append(params, db.AuditEvent.CreatedAt.Gte(from))
+	}
+	if q.To != "" {
+		to, err := time.Parse(time.RFC3339, q.To)
+		if err != nil {
+			return nil, fmt.Errorf("invalid to: %w", err)
+		}
+		params = append(params, db.AuditEvent.CreatedAt.Lt(to))
+	}
+	if q.Before > 0 {
+		params = append(params, db.AuditEvent.Seq.Lt(q.Before))
+	}
+	if q.Limit <= 0 || q.Limit > types.MAX_AUDIT_PAGE_SIZE {
+		q.Limit = types.MAX_AUDIT_PAGE_SIZE
+	}
+
+	events, err := as.prismaClient.AuditEvent.FindMany(params...).OrderBy(
+		db.AuditEvent.Seq.Order(db.SortOrderDesc),
+	).Take(q.Limit).Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]types.AuditEvent, 0, len(events))
+	for i := range events {
+		out = append(out, auditEventFromModel(&events[i]))
+	}
+	return out, nil
+}
+
+// VerifyChain recomputes every hash and checks that each event links to its predecessor.
+func (as *AuditService) VerifyChain(ctx context.Context) (types.AuditChainStatus, error) {
+	const page = 500
+	status := types.AuditChainStatus{Valid: true}
+	prevHash := auditGenesisHash
+
+	for {
+		events, err := as.prismaClient.AuditEvent.FindMany(
+			db.AuditEvent.Seq.Gte(status.Checked),
+		).OrderBy(
+			db.AuditEvent.Seq.Order(db.SortOrderAsc),
+		).Take(page).Exec(ctx)
+		if err != nil {
+			return status, err
+		}
+
+		prevHash = verifyAuditEvents(events, &status, prevHash)
+		if !status.Valid || len(events) < page {
+			return status, nil
+		}
+	}
+}
+
+// verifyAuditEvents checks events that follow the status.Checked events already verified,
+// the last of which hashed to prevHash. It stops at the first broken event and returns the
+// hash the next event has to link to.
+func verifyAuditEvents(events []db.AuditEventModel, status *types.AuditChainStatus, prevHash string) string {
+	for i := range events {
+		e := &events[i]
+		reason := ""
+		switch {
+		case e.Seq != status.Checked:
+			reason = "missing event"
+		case e.PrevHash != prevHash:
+			reason = "previous hash does not match"
+		case auditHash(e) != e.Hash:
+			reason = "event hash does not match its content"
+		}
+		if reason != "" {
+			broken := status.Checked
+			status.Valid, status.BrokenAt, status.Reason = false, &broken, reason
+			return prevHash
+		}
+		prevHash = e.Hash
+		status.Checked++
+	}
+	return prevHash
+}
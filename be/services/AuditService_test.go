@@ -0,0 +1,161 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/prisma/db"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/types"
+)
+
+// auditChain builds n linked events the way AuditService.record does.
+func auditChain(n int) []db.AuditEventModel {
+	events := make([]db.AuditEventModel, n)
+	prevHash := auditGenesisHash
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := range events {
+		username := "alice"
+		e := db.AuditEventModel{InnerAuditEvent: db.InnerAuditEvent{
+			Seq:       i,
+			EventType: types.AuditLoginSucceeded,
+			Username:  &username,
+			Details:   `{"session_id":"s1"}`,
+			CreatedAt: start.Add(time.Duration(i) * time.Minute),
+			PrevHash:  prevHash,
+		}}
+		e.Hash = auditHash(&e)
+		prevHash = e.Hash
+		events[i] = e
+	}
+	return events
+}
+
+// rehash recomputes the hash of events[i] after an edit, as someone covering their tracks would.
+func rehash(events []db.AuditEventModel, i int) {
+	events[i].Hash = auditHash(&events[i])
+}
+
+func TestVerifyAuditEvents(t *testing.T) {
+	tests := []struct {
+		name       string
+		tamper     func(events []db.AuditEventModel) []db.AuditEventModel
+		wantBroken int
+		wantReason string
+	}{
+		{
+			name:       "intact chain",
+			tamper:     func(events []db.AuditEventModel) []db.AuditEventModel { return events },
+			wantBroken: -1,
+		},
+		{
+			name: "edited details",
+			tamper: func(events []db.AuditEventModel) []db.AuditEventModel {
+				events[2].Details = `{"session_id":"s2"}`
+				return events
+			},
+			wantBroken: 2,
+			wantReason: "event hash does not match its content",
+		},
+		{
+			name: "edited event type",
+			tamper: func(events []db.AuditEventModel) []db.AuditEventModel {
+				events[0].EventType = types.AuditLoginFailed
+				return events
+			},
+			wantBroken: 0,
+			wantReason: "event hash does not match its content",
+		},
+		{
+			name: "edited and rehashed event breaks the next link",
+			tamper: func(events []db.AuditEventModel) []db.AuditEventModel {
+				ip := "10.0.0.1"
+				events[1].InnerAuditEvent.IPAddress = &ip
+				rehash(events, 1)
+				return events
+			},
+			wantBroken: 2,
+			wantReason: "previous hash does not match",
+		},
+		{
+			name: "deleted event",
+			tamper: func(events []db.AuditEventModel) []db.AuditEventModel {
+				return append(events[:3], events[4:]...)
+			},
+			wantBroken: 3,
+			wantReason: "missing event",
+		},
+		{
+			name: "deleted last event is not detectable from the chain alone",
+			tamper: func(events []db.AuditEventModel) []db.AuditEventModel {
+				return events[:len(events)-1]
+			},
+			wantBroken: -1,
+		},
+		{
+			name: "swapped events",
+			tamper: func(events []db.AuditEventModel) []db.AuditEventModel {
+				events[1], events[2] = events[2], events[1]
+				return events
+			},
+			wantBroken: 1,
+			wantReason: "missing event",
+		},
+		{
+			name: "renumbered events after a deletion",
+			tamper: func(events []db.AuditEventModel) []db.AuditEventModel {
+				events = append(events[:1], events[2:]...)
+				for i := 1; i < len(events); i++ {
+					events[i].Seq = i
+					rehash(events, i)
+				}
+				return events
+			},
+			wantBroken: 1,
+			wantReason: "previous hash does not match",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := tt.tamper(auditChain(5))
+			status := types.AuditChainStatus{Valid: true}
+			verifyAuditEvents(events, &status, auditGenesisHash)
+
+			if tt.wantBroken < 0 {
+				if !status.Valid || status.Checked != len(events) {
+					t.Fatalf("status = %+v, want a valid chain of %d events", status, len(events))
+				}
+				return
+			}
+			if status.Valid || status.BrokenAt == nil {
+				t.Fatalf("status = %+v, want broken at %d", status, tt.wantBroken)
+			}
+			if *status.BrokenAt != tt.wantBroken || status.Reason != tt.wantReason {
+				t.Errorf("broken at %d (%s), want %d (%s)", *status.BrokenAt, status.Reason, tt.wantBroken, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestVerifyAuditEventsAcrossPages(t *testing.T) {
+	events := auditChain(7)
+	status := types.AuditChainStatus{Valid: true}
+
+	prevHash := verifyAuditEvents(events[:4], &status, auditGenesisHash)
+	verifyAuditEvents(events[4:], &status, prevHash)
+
+	if !status.Valid || status.Checked != len(events) {
+		t.Errorf("status = %+v, want a valid chain of %d events", status, len(events))
+	}
+}
+
+func TestAuditHashSeparatesFields(t *testing.T) {
+	userID, username := "ab", ""
+	shiftedID, shiftedName := "a", "b"
+	a := db.AuditEventModel{InnerAuditEvent: db.InnerAuditEvent{UserID: &userID, Username: &username, PrevHash: auditGenesisHash}}
+	b := db.AuditEventModel{InnerAuditEvent: db.InnerAuditEvent{UserID: &shiftedID, Username: &shiftedName, PrevHash: auditGenesisHash}}
+
+	if auditHash(&a) == auditHash(&b) {
+		t.Error("moving characters between fields does not change the hash")
+	}
+}
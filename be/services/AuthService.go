@@ -1,15 +1,20 @@
 package services
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/sha3"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
 	"math/big"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/steebchen/prisma-client-go/runtime/transaction"
 
 	"github.com/gin-gonic/gin"
 	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/middleware"
@@ -18,14 +23,94 @@ import (
 	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/utils"
 )
 
+// ErrSessionNotFound is returned when a session does not exist or belongs to another user.
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionRevokedFunc is called with the IDs of sessions right after they are revoked.
+type SessionRevokedFunc func(sessionIDs ...string)
+
+// RefreshTokenReuseFunc is called when a consumed refresh token of the user's session is replayed.
+type RefreshTokenReuseFunc func(username, sessionID string)
+
+// DeviceRevokedFunc is called for every device revoked because its owner's identity key changed.
+type DeviceRevokedFunc func(username, deviceID string)
+
 type AuthService struct{
 	prismaClient *db.PrismaClient
+	nonceStore NonceStore
+	revokeListeners []SessionRevokedFunc
+	reuseListeners []RefreshTokenReuseFunc
+	deviceListeners []DeviceRevokedFunc
+	lockout LoginLockout
+	audit *AuditService
 }
 
-func NewAuthService(client *db.PrismaClient) *AuthService {
+func NewAuthService(client *db.PrismaClient, nonceStore NonceStore, lockout LoginLockout, audit *AuditService) *AuthService {
 	return &AuthService{
 		prismaClient: client,
+		nonceStore: nonceStore,
+		lockout: lockout,
+		audit: audit,
+	}
+}
+
+func (as *AuthService) IssueChallenge(ctx *gin.Context, username string) (string, error) {
+	nonce, err := GenerateNonce()
+	if err != nil {
+		return "", err
+	}
+
+	if err := as.nonceStore.Store(ctx, username, nonce, types.EXPIRATION_NONCE); err != nil {
+		return "", err
+	}
+	return nonce, nil
+}
+
+// registrationChallengeKey keeps registration challenges apart from login challenges in the nonce store.
+func registrationChallengeKey(username string) string {
+	return "register:" + username
+}
+
+func (as *AuthService) IssueRegistrationChallenge(ctx *gin.Context, username string) (string, error) {
+	return as.IssueChallenge(ctx, registrationChallengeKey(username))
+}
+
+// ValidatePublicKey checks that the signing key is a P-256 point and the ECDH key a compressed P-256 point.
+func ValidatePublicKey(pk types.PublicKey) error {
+	if err := utils.ValidateP256Point(pk.X, pk.Y); err != nil {
+		return err
+	}
+	return utils.ValidateCompressedP256(pk.Ecdh)
+}
+
+// RegistrationStatement returns the hex encoded statement a new user signs to prove
+// they hold the private key of the submitted signing key.
+func RegistrationStatement(username string, pk types.PublicKey, nonce string) string {
+	statement := strings.Join([]string{"register", username, pk.X, pk.Y, pk.Ecdh, nonce}, "|")
+	return hex.EncodeToString([]byte(statement))
+}
+
+// VerifyRegistration validates the submitted keys and the proof of possession over a
+// registration challenge issued by IssueRegistrationChallenge.
+func (as *AuthService) VerifyRegistration(ctx *gin.Context, req types.RegisterRequest) error {
+	if err := ValidatePublicKey(req.PublicKeyHex); err != nil {
+		return err
+	}
+
+	ok, err := as.nonceStore.Take(ctx, registrationChallengeKey(req.Username), req.Nonce)
+	if err != nil {
+		return fmt.Errorf("failed to take challenge: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("no valid registration challenge found")
+	}
+
+	statement := RegistrationStatement(req.Username, req.PublicKeyHex, req.Nonce)
+	valid, err := as.VerifySignature(req.PublicKeyHex.X, req.PublicKeyHex.Y, statement, req.Signature)
+	if err != nil || !valid {
+		return fmt.Errorf("proof of possession signature is invalid")
 	}
+	return nil
 }
 
 func (as *AuthService) VerifySignature(publicKeyXHex, publicKeyYHex, message string, signatureHex types.Signature) (bool, error) {
@@ -67,27 +152,57 @@ func (as *AuthService) VerifySignature(publicKeyXHex, publicKeyYHex, message str
 	return ecdsa.Verify(pub, hash[:], rBInt, sBInt), nil
 }
 
+// ProcessLogin verifies the signed challenge and opens a new session. Failed signatures count
+// towards a lockout of the username for the client's address, reported as a *LoginLockedError.
 func (as *AuthService) ProcessLogin(ctx *gin.Context, user *db.UserModel, pub types.PublicKey, payload types.LoginRequest) (string, string, error) {
-	nonce, ok := TakeNonce(payload.Username)
+	lockoutKey := LoginLockoutKey(user.Username, ctx.ClientIP())
+	wait, err := as.lockout.RetryAfter(ctx, lockoutKey)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to check login lockout: %w", err)
+	}
+	if wait > 0 {
+		as.audit.Record(ctx, types.AuditLoginLocked, user.ID, user.Username, nil)
+		return "", "", &LoginLockedError{RetryAfter: wait}
+	}
+
+	ok, err := as.nonceStore.Take(ctx, user.Username, payload.Nonce)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to take challenge: %w", err)
+	}
 	if !ok {
 		return "", "", fmt.Errorf("no valid challenge found for user")
 	}
 
-	valid, err := as.VerifySignature(pub.X, pub.Y, nonce, payload.Signature)
+	valid, err := as.VerifySignature(pub.X, pub.Y, payload.Nonce, payload.Signature)
 	if err != nil || !valid {
+		as.audit.Record(ctx, types.AuditLoginFailed, user.ID, user.Username, nil)
+		lock, lockErr := as.lockout.Fail(ctx, lockoutKey)
+		if lockErr != nil {
+			log.Println("Failed to record failed login:", lockErr)
+		}
+		if lock > 0 {
+			as.audit.Record(ctx, types.AuditLoginLocked, user.ID, user.Username, map[string]interface{}{
+				"locked_for_seconds": int(lock.Seconds()),
+			})
+			return "", "", &LoginLockedError{RetryAfter: lock}
+		}
 		if(err == nil) {
 			err = fmt.Errorf("signature verification failed")
 		}
 		return "", "", err
 	}
+	if err := as.lockout.Reset(ctx, lockoutKey); err != nil {
+		log.Println("Failed to reset login failures:", err)
+	}
 
-	accessToken, err := middleware.GenerateAccessToken(user.ID, user.Username)
+	sessionID := uuid.NewString()
+	accessToken, err := middleware.GenerateAccessToken(user.ID, user.Username, sessionID)
 	if err != nil {
 		return "", "", fmt.Errorf("failed to generate access token: %w", err)
 	}
 
-	sessionID := uuid.NewString()
-	refreshToken, err := middleware.GenerateRefreshToken(sessionID, user.Username)
+	sessionExpiresAt := time.Now().Add(types.EXPIRATION_REFRESH_TOKEN)
+	refreshToken, err := middleware.GenerateRefreshToken(sessionID, user.Username, sessionExpiresAt)
 	if err != nil {
 		return "", "", fmt.Errorf("failed to generate refresh token: %w", err)
 	}
@@ -102,7 +217,7 @@ func (as *AuthService) ProcessLogin(ctx *gin.Context, user *db.UserModel, pub ty
 
 	_, err = as.prismaClient.UserSession.CreateOne(
 		db.UserSession.RefreshTokenHash.Set(rtHash),
-		db.UserSession.ExpiresAt.Set(time.Now().Add(types.EXPIRATION_REFRESH_TOKEN)),
+		db.UserSession.ExpiresAt.Set(sessionExpiresAt),
 		db.UserSession.User.Link(db.User.ID.Equals(user.ID)),
 		db.UserSession.ID.Set(sessionID),
 		db.UserSession.UserAgent.Set(userAgent),
@@ -112,17 +227,360 @@ func (as *AuthService) ProcessLogin(ctx *gin.Context, user *db.UserModel, pub ty
 	if err != nil {
 		return "", "", fmt.Errorf("failed to create user session: %w", err)
 	}
+	as.audit.Record(ctx, types.AuditLoginSucceeded, user.ID, user.Username, map[string]interface{}{
+		"session_id": sessionID,
+	})
 
 	return accessToken, refreshToken, nil
 }
 
-func (as *AuthService) RevokeAllSessions(ctx *gin.Context, userID string) error {
-	_, err := as.prismaClient.UserSession.FindMany(
-		db.UserSession.UserID.Equals(userID),
+func wsTicketKey(sessionID string) string {
+	return "ws-ticket:" + sessionID
+}
+
+// wsTicketAddress is the address a ticket is bound to. ClientIP only follows X-Forwarded-For
+// from proxies in TRUSTED_PROXIES, so a client cannot pick the address it is bound to.
+func wsTicketAddress(ctx *gin.Context) string {
+	return ctx.ClientIP()
+}
+
+// IssueWSTicket returns a single use ticket for opening a chat socket from the caller's address.
+func (as *AuthService) IssueWSTicket(ctx *gin.Context, userID, username, sessionID string, tokenExpiresAt time.Time) (string, error) {
+	ticket, claims, err := middleware.GenerateWSTicket(userID, username, sessionID, wsTicketAddress(ctx), tokenExpiresAt)
+	if err != nil {
+		return "", err
+	}
+	if err := as.nonceStore.Store(ctx, wsTicketKey(sessionID), claims.ID, types.EXPIRATION_WS_TICKET); err != nil {
+		return "", fmt.Errorf("failed to store ticket: %w", err)
+	}
+	return ticket, nil
+}
+
+// RedeemWSTicket consumes ticket. It fails if the ticket was used before, expired or is
+// presented from another address than it was issued to.
+func (as *AuthService) RedeemWSTicket(ctx *gin.Context, ticket string) (*middleware.WSTicketClaims, error) {
+	claims, err := middleware.VerifyWSTicket(ticket)
+	if err != nil {
+		return nil, err
+	}
+	if claims.IPAddress == "" || claims.IPAddress != wsTicketAddress(ctx) {
+		return nil, fmt.Errorf("ticket was issued to another address")
+	}
+	ok, err := as.nonceStore.Take(ctx, wsTicketKey(claims.SessionID), claims.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to take ticket: %w", err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("ticket was already used")
+	}
+	return claims, nil
+}
+
+// KeyRotationStatement returns the hex encoded statement a user signs with the old key
+// to authorize switching to newKey.
+func KeyRotationStatement(username string, newKey types.PublicKey, timestamp string) string {
+	statement := strings.Join([]string{"rotate-key", username, newKey.X, newKey.Y, newKey.Ecdh, timestamp}, "|")
+	return hex.EncodeToString([]byte(statement))
+}
+
+// RotateIdentityKey replaces the user's signing and ECDH keys after checking that the
+// rotation statement was signed by the current key. The old key is kept in the history.
+func (as *AuthService) RotateIdentityKey(ctx *gin.Context, user *db.UserModel, req types.KeyRotationRequest) (*db.UserKeyModel, error) {
+	newKey := req.PublicKeyHex
+	if err := ValidatePublicKey(newKey); err != nil {
+		return nil, fmt.Errorf("invalid new public key: %w", err)
+	}
+
+	signedAt, err := time.Parse(time.RFC3339, req.Timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rotation timestamp: %w", err)
+	}
+	if skew := time.Since(signedAt); skew > types.KEY_ROTATION_MAX_SKEW || skew < -types.KEY_ROTATION_MAX_SKEW {
+		return nil, fmt.Errorf("rotation statement is too old or too far in the future")
+	}
+
+	statement := KeyRotationStatement(user.Username, newKey, req.Timestamp)
+	valid, err := as.VerifySignature(user.PublicKeyX, user.PublicKeyY, statement, req.Signature)
+	if err != nil || !valid {
+		return nil, fmt.Errorf("rotation statement is not signed by the current key")
+	}
+
+	key, err := as.replaceIdentityKey(ctx, user, newKey, []db.UserKeySetParam{
+		db.UserKey.RotationSignatureR.Set(req.Signature.R),
+		db.UserKey.RotationSignatureS.Set(req.Signature.S),
+	})
+	if err != nil {
+		return nil, err
+	}
+	as.audit.Record(ctx, types.AuditKeyRotated, user.ID, user.Username, map[string]interface{}{
+		"key_id": key.ID,
+	})
+	return key, nil
+}
+
+// ResetIdentityKey replaces the user's keys without a signature from the current key.
+// It is only meant for recovery, after the account owner was authorized by the recovery
+// request recoveryRequestID. The new key references the request, so resetting twice for the
+// same request fails with a unique constraint error. txs run in the same transaction.
+func (as *AuthService) ResetIdentityKey(ctx context.Context, user *db.UserModel, newKey types.PublicKey, recoveryRequestID string, txs ...transaction.Transaction) (*db.UserKeyModel, error) {
+	if err := ValidatePublicKey(newKey); err != nil {
+		return nil, fmt.Errorf("invalid new public key: %w", err)
+	}
+	return as.replaceIdentityKey(ctx, user, newKey, []db.UserKeySetParam{
+		db.UserKey.RecoveryRequestID.Set(recoveryRequestID),
+	}, txs...)
+}
+
+// replaceIdentityKey closes the user's open key, records newKey as the current one and
+// updates the user, all in one transaction together with extra. Devices were certified by the
+// old key, so they are revoked in the same transaction and have to be registered again.
+func (as *AuthService) replaceIdentityKey(ctx context.Context, user *db.UserModel, newKey types.PublicKey, params []db.UserKeySetParam, extra ...transaction.Transaction) (*db.UserKeyModel, error) {
+	now := time.Now()
+	var txs []transaction.Transaction
+
+	devices, err := as.prismaClient.Device.FindMany(
+		db.Device.UserID.Equals(user.ID),
+		db.Device.RevokedAt.IsNull(),
+	).Exec(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load devices: %w", err)
+	}
+
+	_, err = as.prismaClient.UserKey.FindFirst(
+		db.UserKey.UserID.Equals(user.ID),
+		db.UserKey.ValidUntil.IsNull(),
+	).Exec(ctx)
+	if errors.Is(err, db.ErrNotFound) {
+		// accounts created before key history existed get their original key recorded first
+		txs = append(txs, as.prismaClient.UserKey.CreateOne(
+			db.UserKey.PublicKeyX.Set(user.PublicKeyX),
+			db.UserKey.PublicKeyY.Set(user.PublicKeyY),
+			db.UserKey.PublicKeyEcdh.Set(user.PublicKeyEcdh),
+			db.UserKey.User.Link(db.User.ID.Equals(user.ID)),
+			db.UserKey.ValidFrom.Set(time.Unix(0, 0)),
+			db.UserKey.ValidUntil.Set(now),
+		).Tx())
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to load current key: %w", err)
+	}
+
+	created := as.prismaClient.UserKey.CreateOne(
+		db.UserKey.PublicKeyX.Set(newKey.X),
+		db.UserKey.PublicKeyY.Set(newKey.Y),
+		db.UserKey.PublicKeyEcdh.Set(newKey.Ecdh),
+		db.UserKey.User.Link(db.User.ID.Equals(user.ID)),
+		append([]db.UserKeySetParam{db.UserKey.ValidFrom.Set(now)}, params...)...,
+	).Tx()
+
+	txs = append(txs,
+		as.prismaClient.UserKey.FindMany(
+			db.UserKey.UserID.Equals(user.ID),
+			db.UserKey.ValidUntil.IsNull(),
+		).Update(
+			db.UserKey.ValidUntil.Set(now),
+		).Tx(),
+		created,
+		as.prismaClient.User.FindUnique(
+			db.User.ID.Equals(user.ID),
+		).Update(
+			db.User.PublicKeyX.Set(newKey.X),
+			db.User.PublicKeyY.Set(newKey.Y),
+			db.User.PublicKeyEcdh.Set(newKey.Ecdh),
+		).Tx(),
+		as.prismaClient.Device.FindMany(
+			db.Device.UserID.Equals(user.ID),
+			db.Device.RevokedAt.IsNull(),
+		).Update(
+			db.Device.RevokedAt.Set(now),
+		).Tx(),
+	)
+	txs = append(txs, extra...)
+
+	if err := as.prismaClient.Prisma.Transaction(txs...).Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to replace key: %w", err)
+	}
+
+	for _, device := range devices {
+		as.audit.Record(ctx, types.AuditDeviceRevoked, user.ID, user.Username, map[string]interface{}{
+			"device_id": device.ID,
+			"reason":    "identity_key_replaced",
+		})
+		for _, fn := range as.deviceListeners {
+			fn(user.Username, device.ID)
+		}
+	}
+	return created.Result(), nil
+}
+
+// AccountDeletionStatement returns the hex encoded statement a user signs to delete their account.
+func AccountDeletionStatement(username, timestamp string) string {
+	statement := strings.Join([]string{"delete-account", username, timestamp}, "|")
+	return hex.EncodeToString([]byte(statement))
+}
+
+// DeleteAccount removes the user after checking the deletion statement was signed by the
+// current key. Friendships and every message the user sent or received are deleted with it,
+// and keys, devices and sessions go through the cascade, so nothing the user could decrypt
+// or sign with is left behind. The username stays reserved for USERNAME_RESERVATION.
+func (as *AuthService) DeleteAccount(ctx *gin.Context, user *db.UserModel, req types.AccountDeletionRequest) error {
+	signedAt, err := time.Parse(time.RFC3339, req.Timestamp)
+	if err != nil {
+		return fmt.Errorf("invalid deletion timestamp: %w", err)
+	}
+	if skew := time.Since(signedAt); skew > types.ACCOUNT_DELETION_MAX_SKEW || skew < -types.ACCOUNT_DELETION_MAX_SKEW {
+		return fmt.Errorf("deletion statement is too old or too far in the future")
+	}
+
+	statement := AccountDeletionStatement(user.Username, req.Timestamp)
+	valid, err := as.VerifySignature(user.PublicKeyX, user.PublicKeyY, statement, req.Signature)
+	if err != nil || !valid {
+		return fmt.Errorf("deletion statement is not signed by the current key")
+	}
+
+	sessions, err := as.prismaClient.UserSession.FindMany(
+		db.UserSession.UserID.Equals(user.ID),
+		db.UserSession.IsRevoked.Equals(false),
+	).Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load sessions: %w", err)
+	}
+
+	err = as.prismaClient.Prisma.Transaction(
+		as.prismaClient.UserFriend.FindMany(
+			db.UserFriend.Or(
+				db.UserFriend.User1ID.Equals(user.ID),
+				db.UserFriend.User2ID.Equals(user.ID),
+			),
+		).Delete().Tx(),
+		as.prismaClient.Message.FindMany(
+			db.Message.Or(
+				db.Message.SenderID.Equals(user.ID),
+				db.Message.ReceiverID.Equals(user.ID),
+			),
+		).Delete().Tx(),
+		as.prismaClient.DeletedUsername.FindMany(
+			db.DeletedUsername.Username.Equals(user.Username),
+		).Delete().Tx(),
+		as.prismaClient.DeletedUsername.CreateOne(
+			db.DeletedUsername.Username.Set(user.Username),
+			db.DeletedUsername.Skeleton.Set(utils.UsernameSkeleton(user.Username)),
+			db.DeletedUsername.ReservedUntil.Set(time.Now().Add(types.USERNAME_RESERVATION)),
+		).Tx(),
+		as.prismaClient.User.FindUnique(
+			db.User.ID.Equals(user.ID),
+		).Delete().Tx(),
+	).Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to delete account: %w", err)
+	}
+	as.audit.Record(ctx, types.AuditAccountDeleted, user.ID, user.Username, nil)
+
+	ids := make([]string, 0, len(sessions))
+	for _, session := range sessions {
+		ids = append(ids, session.ID)
+	}
+	as.notifyRevoked(ids...)
+	return nil
+}
+
+// OnSessionsRevoked registers fn to be called whenever sessions are revoked,
+// e.g. so live WebSocket connections bound to them can be closed.
+func (as *AuthService) OnSessionsRevoked(fn SessionRevokedFunc) {
+	as.revokeListeners = append(as.revokeListeners, fn)
+}
+
+// OnRefreshTokenReuse registers fn to be called when refresh token reuse is detected.
+func (as *AuthService) OnRefreshTokenReuse(fn RefreshTokenReuseFunc) {
+	as.reuseListeners = append(as.reuseListeners, fn)
+}
+
+// OnDeviceRevoked registers fn to be called for devices revoked by a key rotation or recovery.
+func (as *AuthService) OnDeviceRevoked(fn DeviceRevokedFunc) {
+	as.deviceListeners = append(as.deviceListeners, fn)
+}
+
+func (as *AuthService) notifyRevoked(sessionIDs ...string) {
+	if len(sessionIDs) == 0 {
+		return
+	}
+	for _, fn := range as.revokeListeners {
+		fn(sessionIDs...)
+	}
+}
+
+// SyncRevocations forwards sessions revoked within the lifetime of an access token to the
+// listeners, including ones revoked by other replicas. known reports sessions that were
+// already forwarded.
+func (as *AuthService) SyncRevocations(ctx context.Context, known func(sessionID string) bool) error {
+	sessions, err := as.prismaClient.UserSession.FindMany(
+		db.UserSession.IsRevoked.Equals(true),
+		db.UserSession.RevokedAt.After(time.Now().Add(-types.EXPIRATION_ACCESS_TOKEN)),
+	).Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]string, 0)
+	for _, s := range sessions {
+		if !known(s.ID) {
+			ids = append(ids, s.ID)
+		}
+	}
+	as.notifyRevoked(ids...)
+	return nil
+}
+
+// RunRevocationSync calls SyncRevocations every interval until ctx is cancelled.
+func RunRevocationSync(ctx context.Context, as *AuthService, known func(sessionID string) bool, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := as.SyncRevocations(ctx, known); err != nil {
+			log.Println("Failed to sync revoked sessions:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// revokeWhere revokes every still active session matching params and notifies the listeners.
+func (as *AuthService) revokeWhere(ctx *gin.Context, params ...db.UserSessionWhereParam) (int, error) {
+	params = append(params, db.UserSession.IsRevoked.Equals(false))
+	sessions, err := as.prismaClient.UserSession.FindMany(params...).Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if len(sessions) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]string, 0, len(sessions))
+	for _, s := range sessions {
+		ids = append(ids, s.ID)
+	}
+	_, err = as.prismaClient.UserSession.FindMany(
+		db.UserSession.ID.In(ids),
 	).Update(
 		db.UserSession.IsRevoked.Set(true),
+		db.UserSession.RevokedAt.Set(time.Now()),
 	).Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+	as.audit.Record(ctx, types.AuditSessionRevoked, sessions[0].UserID, "", map[string]interface{}{
+		"session_ids": ids,
+	})
 
+	as.notifyRevoked(ids...)
+	return len(ids), nil
+}
+
+func (as *AuthService) RevokeAllSessions(ctx *gin.Context, userID string) error {
+	_, err := as.revokeWhere(ctx, db.UserSession.UserID.Equals(userID))
 	return err
 }
 
@@ -131,8 +589,67 @@ func (as *AuthService) RevokeSession(ctx *gin.Context, session *db.UserSessionMo
 		db.UserSession.ID.Equals(session.ID),
 	).Update(
 		db.UserSession.IsRevoked.Set(true),
+		db.UserSession.RevokedAt.Set(time.Now()),
 	).Exec(ctx)
-	return err
+	if err != nil {
+		return err
+	}
+	as.audit.Record(ctx, types.AuditSessionRevoked, session.UserID, "", map[string]interface{}{
+		"session_ids": []string{session.ID},
+	})
+
+	as.notifyRevoked(session.ID)
+	return nil
+}
+
+// ListSessions returns the user's sessions that are neither revoked nor expired, newest first.
+func (as *AuthService) ListSessions(ctx *gin.Context, userID string) ([]db.UserSessionModel, error) {
+	return as.prismaClient.UserSession.FindMany(
+		db.UserSession.UserID.Equals(userID),
+		db.UserSession.IsRevoked.Equals(false),
+		db.UserSession.ExpiresAt.After(time.Now()),
+	).OrderBy(
+		db.UserSession.CreatedAt.Order(db.SortOrderDesc),
+	).Exec(ctx)
+}
+
+func (as *AuthService) RenameSession(ctx *gin.Context, userID, sessionID, name string) error {
+	res, err := as.prismaClient.UserSession.FindMany(
+		db.UserSession.ID.Equals(sessionID),
+		db.UserSession.UserID.Equals(userID),
+	).Update(
+		db.UserSession.Name.Set(name),
+	).Exec(ctx)
+	if err != nil {
+		return err
+	}
+	if res.Count == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeSessionByID revokes one of the user's own sessions.
+func (as *AuthService) RevokeSessionByID(ctx *gin.Context, userID, sessionID string) error {
+	n, err := as.revokeWhere(ctx,
+		db.UserSession.ID.Equals(sessionID),
+		db.UserSession.UserID.Equals(userID),
+	)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeOtherSessions revokes every session of the user except keepSessionID.
+func (as *AuthService) RevokeOtherSessions(ctx *gin.Context, userID, keepSessionID string) (int, error) {
+	return as.revokeWhere(ctx,
+		db.UserSession.UserID.Equals(userID),
+		db.UserSession.Not(db.UserSession.ID.Equals(keepSessionID)),
+	)
 }
 
 func (as *AuthService) VerifyRefreshTokenAndSession(ctx *gin.Context, tokenStr string) (*middleware.RefreshTokenClaims, *db.UserSessionModel, error) {
@@ -152,12 +669,91 @@ func (as *AuthService) VerifyRefreshTokenAndSession(ctx *gin.Context, tokenStr s
 		return nil, nil, fmt.Errorf("refresh token has expired")
 	}
 
-	if session.IsRevoked||!utils.CompareRefreshTokenHash(session.RefreshTokenHash, tokenStr) {
-		if as.RevokeAllSessions(ctx, session.UserID)!=nil {
-			return nil, nil, fmt.Errorf("failed to revoke missue session")
-		}
-		return nil, nil, fmt.Errorf("refresh token reuse detected, all sessions revoked")
+	if session.IsRevoked {
+		return nil, nil, fmt.Errorf("session has been revoked")
+	}
+
+	if !utils.CompareRefreshTokenHash(session.RefreshTokenHash, tokenStr) {
+		return nil, nil, as.handleRefreshTokenReuse(ctx, claims, session, tokenStr)
 	}
 
 	return claims, session, nil
-}
\ No newline at end of file
+}
+
+// refreshTokenID identifies a refresh token within its family. Tokens issued before
+// rotation carry no jti, so their hash is used instead.
+func refreshTokenID(claims *middleware.RefreshTokenClaims, tokenStr string) string {
+	if claims.ID != "" {
+		return claims.ID
+	}
+	sum := sha3.Sum256([]byte(tokenStr))
+	return hex.EncodeToString(sum[:])
+}
+
+// handleRefreshTokenReuse is called when a correctly signed refresh token is no longer the
+// current one of its session. Unless it was rotated a moment ago by a concurrent request,
+// the token was stolen or replayed, so the whole family is revoked and the user is alerted.
+func (as *AuthService) handleRefreshTokenReuse(ctx *gin.Context, claims *middleware.RefreshTokenClaims, session *db.UserSessionModel, tokenStr string) error {
+	consumed, err := as.prismaClient.ConsumedRefreshToken.FindUnique(
+		db.ConsumedRefreshToken.Jti.Equals(refreshTokenID(claims, tokenStr)),
+	).Exec(ctx)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return fmt.Errorf("failed to look up refresh token: %w", err)
+	}
+	if consumed != nil && consumed.SessionID == session.ID && time.Since(consumed.ConsumedAt) < types.REFRESH_TOKEN_REUSE_GRACE {
+		return fmt.Errorf("refresh token was just rotated, use the new one")
+	}
+
+	as.audit.Record(ctx, types.AuditRefreshTokenReuse, session.UserID, claims.Username, map[string]interface{}{
+		"session_id": session.ID,
+	})
+	for _, fn := range as.reuseListeners {
+		fn(claims.Username, session.ID)
+	}
+	if err := as.RevokeSession(ctx, session); err != nil {
+		return fmt.Errorf("failed to revoke misused session")
+	}
+	return fmt.Errorf("refresh token reuse detected, session revoked")
+}
+
+// RotateRefreshToken replaces the session's refresh token with a new one and remembers the
+// old one as consumed, so presenting it again is detected as a replay. The session keeps its
+// original expiry.
+func (as *AuthService) RotateRefreshToken(ctx *gin.Context, claims *middleware.RefreshTokenClaims, session *db.UserSessionModel, tokenStr string) (string, error) {
+	refreshToken, err := middleware.GenerateRefreshToken(session.ID, claims.Username, session.ExpiresAt)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+
+	rtHash, err := utils.HashRefreshToken(refreshToken)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash refresh token: %w", err)
+	}
+
+	// the consumed record and the swap are written together: the record is what reuse
+	// detection relies on, and its unique jti makes a concurrent rotation of the same token fail
+	consumed := as.prismaClient.ConsumedRefreshToken.CreateOne(
+		db.ConsumedRefreshToken.Jti.Set(refreshTokenID(claims, tokenStr)),
+		db.ConsumedRefreshToken.Session.Link(db.UserSession.ID.Equals(session.ID)),
+	).Tx()
+	// only swap if nobody rotated the token in the meantime
+	swapped := as.prismaClient.UserSession.FindMany(
+		db.UserSession.ID.Equals(session.ID),
+		db.UserSession.RefreshTokenHash.Equals(session.RefreshTokenHash),
+		db.UserSession.IsRevoked.Equals(false),
+	).Update(
+		db.UserSession.RefreshTokenHash.Set(rtHash),
+	).Tx()
+	err = as.prismaClient.Prisma.Transaction(consumed, swapped).Exec(ctx)
+	if _, ok := db.IsErrUniqueConstraint(err); ok {
+		return "", fmt.Errorf("refresh token was already rotated")
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to rotate refresh token: %w", err)
+	}
+	if swapped.Result().Count == 0 {
+		return "", fmt.Errorf("refresh token was already rotated")
+	}
+
+	return refreshToken, nil
+}
@@ -2,60 +2,197 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
 	"strconv"
-	_ "time"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/prisma/db"
 	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/types"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/utils"
+	"github.com/steebchen/prisma-client-go/runtime/transaction"
 )
 
+// ErrInvalidSignature is returned when a message signature does not match the sender's public key.
+var ErrInvalidSignature = errors.New("invalid message signature")
+
+// ErrUnknownDevice is returned when a per-device ciphertext is addressed to a device that
+// does not belong to the sender or receiver, or has been revoked.
+var ErrUnknownDevice = errors.New("unknown recipient device")
+
+// ErrMissingDevices is returned when per-device ciphertexts leave out an active device of the
+// receiver, which usually means the sender works from a stale device list.
+var ErrMissingDevices = errors.New("ciphertext missing for receiver device")
+
+// ErrUnknownReceiver is returned when the receiver username does not exist.
+var ErrUnknownReceiver = errors.New("receiver not found")
+
+// ErrInvalidMessageID is returned when a message ID is not a number, or not the ID of a
+// message of the user.
+var ErrInvalidMessageID = errors.New("invalid message id")
+
 type ChatService struct {
     prismaClient *db.PrismaClient
+    authService  *AuthService
 }
 
-func NewChatService(client *db.PrismaClient) *ChatService {
-    return &ChatService{prismaClient: client}
+func NewChatService(client *db.PrismaClient, authService *AuthService) *ChatService {
+    return &ChatService{prismaClient: client, authService: authService}
 }
 
-func (cs *ChatService) SaveIncomingMessage(ctx context.Context, in types.IncomingPayload) (types.IncomingPayload, error) {
+// SaveIncomingMessage persists a message sent by the authenticated user senderID.
+// The sender username in the payload is overwritten with the one stored for senderID,
+// so a client can never store a message on behalf of someone else.
+// Messages sent from a device, senderDeviceID, are verified against that device's key.
+func (cs *ChatService) SaveIncomingMessage(ctx context.Context, senderID, senderDeviceID string, in types.IncomingPayload) (types.IncomingPayload, error) {
 	sender, err := cs.prismaClient.User.
-		FindUnique(db.User.Username.Equals(in.SenderUsername)).
+		FindUnique(db.User.ID.Equals(senderID)).
 		Exec(ctx)
 	if err != nil || sender == nil {
 		return types.IncomingPayload{}, fmt.Errorf("sender not found")
 	}
+	in.SenderUsername = sender.Username
+	in.ReceiverUsername = utils.CanonicalUsername(in.ReceiverUsername)
 
 	receiver, err := cs.prismaClient.User.
 		FindUnique(db.User.Username.Equals(in.ReceiverUsername)).
 		Exec(ctx)
 	if err != nil || receiver == nil {
-		return types.IncomingPayload{}, fmt.Errorf("receiver not found")
+		return types.IncomingPayload{}, ErrUnknownReceiver
 	}
 
+	// the current key is read once, so the key recorded below is the one that verified the message
+	signingKeyX, signingKeyY, senderKeyID := sender.PublicKeyX, sender.PublicKeyY, ""
+	in.SenderDeviceID = senderDeviceID
+	if senderDeviceID == "" {
+		senderKey, err := cs.prismaClient.UserKey.FindFirst(
+			db.UserKey.UserID.Equals(sender.ID),
+			db.UserKey.ValidUntil.IsNull(),
+		).Exec(ctx)
+		if err == nil {
+			signingKeyX, signingKeyY, senderKeyID = senderKey.PublicKeyX, senderKey.PublicKeyY, senderKey.ID
+		} else if !errors.Is(err, db.ErrNotFound) {
+			return types.IncomingPayload{}, err
+		}
+	} else {
+		device, err := cs.prismaClient.Device.FindFirst(
+			db.Device.ID.Equals(senderDeviceID),
+			db.Device.UserID.Equals(sender.ID),
+			db.Device.RevokedAt.IsNull(),
+		).Exec(ctx)
+		if err != nil {
+			return types.IncomingPayload{}, ErrUnknownDevice
+		}
+		signingKeyX, signingKeyY = device.PublicKeyX, device.PublicKeyY
+	}
+
+	valid, err := cs.authService.VerifySignature(signingKeyX, signingKeyY, in.MessageHash, types.Signature{
+		R: in.Signature.R,
+		S: in.Signature.S,
+	})
+	if err != nil || !valid {
+		return types.IncomingPayload{}, ErrInvalidSignature
+	}
+	verifiedAt := time.Now()
+
+	if err := cs.checkDeviceCiphertexts(ctx, sender.ID, receiver.ID, in.Ciphertexts); err != nil {
+		return types.IncomingPayload{}, err
+	}
+
+	params := []db.MessageSetParam{
+		db.Message.VerifiedAt.Set(verifiedAt),
+	}
+	if senderDeviceID != "" {
+		params = append(params, db.Message.SenderDeviceID.Set(senderDeviceID))
+	} else if senderKeyID != "" {
+		// remember which key verified the message so it can still be checked after a rotation
+		params = append(params, db.Message.SenderKeyID.Set(senderKeyID))
+		in.SenderKeyID = senderKeyID
+	}
+
+	// the message and its device copies are written together, copies link to the message by uid
+	uid := uuid.NewString()
+	params = append(params, db.Message.UID.Set(uid))
+
 	timestampISO := in.Timestamp // string yang dikirim FE
-	_, err = cs.prismaClient.Message.CreateOne(
-        db.Message.Chipertext.Set(in.EncryptedMessage),
-        db.Message.MessageHash.Set(in.MessageHash),
-        db.Message.SignatureR.Set(in.Signature.R),
-        db.Message.SignatureS.Set(in.Signature.S),
-  		db.Message.TimestampRaw.Set(timestampISO),
-        db.Message.Sender.Link(
-            db.User.Username.Equals(in.SenderUsername),
-        ),
-        db.Message.Receiver.Link(
-            db.User.Username.Equals(in.ReceiverUsername),
-        ),
-    ).Exec(ctx)
-	if err != nil {
+	created := cs.prismaClient.Message.CreateOne(
+		db.Message.Chipertext.Set(in.EncryptedMessage),
+		db.Message.MessageHash.Set(in.MessageHash),
+		db.Message.SignatureR.Set(in.Signature.R),
+		db.Message.SignatureS.Set(in.Signature.S),
+		db.Message.TimestampRaw.Set(timestampISO),
+		db.Message.Sender.Link(
+			db.User.ID.Equals(sender.ID),
+		),
+		db.Message.Receiver.Link(
+			db.User.Username.Equals(in.ReceiverUsername),
+		),
+		params...,
+	).Tx()
+
+	txs := []transaction.Transaction{created}
+	for _, dc := range in.Ciphertexts {
+		txs = append(txs, cs.prismaClient.MessageDeviceCopy.CreateOne(
+			db.MessageDeviceCopy.Chipertext.Set(dc.EncryptedMessage),
+			db.MessageDeviceCopy.Message.Link(db.Message.UID.Equals(uid)),
+			db.MessageDeviceCopy.Device.Link(db.Device.ID.Equals(dc.DeviceID)),
+		).Tx())
+	}
+	if err := cs.prismaClient.Prisma.Transaction(txs...).Exec(ctx); err != nil {
 		return types.IncomingPayload{}, err
 	}
+	msg := created.Result()
 
+	in.ID = strconv.Itoa(msg.ID)
+	in.VerifiedAt = verifiedAt.Format(time.RFC3339)
 	return in, nil
 }
 
-func (cs *ChatService) ListHistory(ctx context.Context, a, b string) ([]types.IncomingPayload, error) {
+// checkDeviceCiphertexts makes sure per-device ciphertexts only target active devices of the
+// sender or receiver. A sender that encrypts per device opts in to fan-out, so every active
+// device of the receiver must then get a copy. A message without copies is only delivered to
+// sockets that are not bound to a device, device sockets are only ever sent their own copy.
+func (cs *ChatService) checkDeviceCiphertexts(ctx context.Context, senderID, receiverID string, copies []types.DeviceCiphertext) error {
+	if len(copies) == 0 {
+		return nil
+	}
+	if len(copies) > 2*types.MAX_DEVICES_PER_USER {
+		return ErrUnknownDevice
+	}
+
+	devices, err := cs.prismaClient.Device.FindMany(
+		db.Device.UserID.In([]string{senderID, receiverID}),
+		db.Device.RevokedAt.IsNull(),
+	).Exec(ctx)
+	if err != nil {
+		return err
+	}
+	owner := make(map[string]string, len(devices))
+	for _, d := range devices {
+		owner[d.ID] = d.UserID
+	}
+
+	covered := make(map[string]bool, len(copies))
+	for _, dc := range copies {
+		if _, ok := owner[dc.DeviceID]; !ok || covered[dc.DeviceID] {
+			return ErrUnknownDevice
+		}
+		covered[dc.DeviceID] = true
+	}
+	for id, userID := range owner {
+		if userID == receiverID && !covered[id] {
+			return ErrMissingDevices
+		}
+	}
+	return nil
+}
+
+// ListHistory returns the conversation between a and b. With a deviceID, messages that were
+// encrypted per device carry the ciphertext addressed to that device.
+func (cs *ChatService) ListHistory(ctx context.Context, a, b, deviceID string) ([]types.IncomingPayload, error) {
     sender, err := cs.prismaClient.User.FindUnique(
         db.User.Username.Equals(a),
     ).Exec(ctx)
@@ -82,25 +219,234 @@ func (cs *ChatService) ListHistory(ctx context.Context, a, b string) ([]types.In
     if err != nil {
         return nil, err
     }
+
+    deviceCopies := map[int]string{}
+    if deviceID != "" && len(ms) > 0 {
+        ids := make([]int, 0, len(ms))
+        for _, m := range ms {
+            ids = append(ids, m.ID)
+        }
+        copies, err := cs.prismaClient.MessageDeviceCopy.FindMany(
+            db.MessageDeviceCopy.DeviceID.Equals(deviceID),
+            db.MessageDeviceCopy.Device.Where(db.Device.UserID.Equals(sender.ID)),
+            db.MessageDeviceCopy.MessageID.In(ids),
+        ).Exec(ctx)
+        if err != nil {
+            return nil, err
+        }
+        for _, dc := range copies {
+            deviceCopies[dc.MessageID] = dc.Chipertext
+        }
+    }
 	
     out := make([]types.IncomingPayload, 0, len(ms))
-    for _, m := range ms {
-        out = append(out, types.IncomingPayload{
-            ID:               strconv.Itoa(m.ID),
-            SenderUsername:   idToUsername[m.SenderID],
-            ReceiverUsername: idToUsername[m.ReceiverID],
-            EncryptedMessage: m.Chipertext,
-            MessageHash:      m.MessageHash,
-            Signature: struct {
-                R string `json:"r"`
-                S string `json:"s"`
-            }{R: m.SignatureR, S: m.SignatureS},
-            Timestamp: m.TimestampRaw,
-        })
+    for i := range ms {
+        m := &ms[i]
+        ciphertext, targetDevice := m.Chipertext, ""
+        if c, ok := deviceCopies[m.ID]; ok {
+            ciphertext, targetDevice = c, deviceID
+        }
+        out = append(out, incomingFromModel(m, idToUsername[m.SenderID], idToUsername[m.ReceiverID], ciphertext, targetDevice))
     }
     return out, nil
 }
 
+// incomingFromModel converts a stored message, with ciphertext being the copy addressed to
+// deviceID, or the account level one when deviceID is empty.
+func incomingFromModel(m *db.MessageModel, senderUsername, receiverUsername, ciphertext, deviceID string) types.IncomingPayload {
+	out := types.IncomingPayload{
+		ID:               strconv.Itoa(m.ID),
+		SenderUsername:   senderUsername,
+		ReceiverUsername: receiverUsername,
+		EncryptedMessage: ciphertext,
+		MessageHash:      m.MessageHash,
+		Timestamp:        m.TimestampRaw,
+		DeviceID:         deviceID,
+	}
+	out.Signature.R, out.Signature.S = m.SignatureR, m.SignatureS
+	if v, ok := m.VerifiedAt(); ok {
+		out.VerifiedAt = v.Format(time.RFC3339)
+	}
+	out.SenderKeyID, _ = m.SenderKeyID()
+	out.SenderDeviceID, _ = m.SenderDeviceID()
+	if t, ok := m.DeliveredAt(); ok {
+		out.DeliveredAt = t.Format(time.RFC3339)
+	}
+	if t, ok := m.ReadAt(); ok {
+		out.ReadAt = t.Format(time.RFC3339)
+	}
+	return out
+}
+
+// MessagesAfter returns up to limit messages userID sent or received with an ID above after,
+// oldest first, across all conversations. With a deviceID only the ciphertext addressed to
+// that device is included, like on live delivery; messages without one come with an empty
+// encrypted_message.
+func (cs *ChatService) MessagesAfter(ctx context.Context, userID, deviceID string, after, limit int) ([]types.IncomingPayload, error) {
+	ms, err := cs.prismaClient.Message.FindMany(
+		db.Message.ID.Gt(after),
+		db.Message.Or(
+			db.Message.SenderID.Equals(userID),
+			db.Message.ReceiverID.Equals(userID),
+		),
+	).With(
+		db.Message.Sender.Fetch(),
+		db.Message.Receiver.Fetch(),
+	).OrderBy(db.Message.ID.Order(db.SortOrderAsc)).Take(limit).Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceCopies := map[int]string{}
+	if deviceID != "" && len(ms) > 0 {
+		ids := make([]int, 0, len(ms))
+		for _, m := range ms {
+			ids = append(ids, m.ID)
+		}
+		copies, err := cs.prismaClient.MessageDeviceCopy.FindMany(
+			db.MessageDeviceCopy.DeviceID.Equals(deviceID),
+			db.MessageDeviceCopy.Device.Where(db.Device.UserID.Equals(userID)),
+			db.MessageDeviceCopy.MessageID.In(ids),
+		).Exec(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, dc := range copies {
+			deviceCopies[dc.MessageID] = dc.Chipertext
+		}
+	}
+
+	out := make([]types.IncomingPayload, 0, len(ms))
+	for i := range ms {
+		m := &ms[i]
+		ciphertext, targetDevice := m.Chipertext, ""
+		if deviceID != "" {
+			ciphertext, targetDevice = deviceCopies[m.ID], deviceID
+		}
+		out = append(out, incomingFromModel(m, m.Sender().Username, m.Receiver().Username, ciphertext, targetDevice))
+	}
+	return out, nil
+}
+
+// DeliveryCursor returns the ID of the newest message userID acknowledged, "0" if none.
+func (cs *ChatService) DeliveryCursor(ctx context.Context, userID string) (string, error) {
+	user, err := cs.prismaClient.User.FindUnique(db.User.ID.Equals(userID)).Exec(ctx)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(user.DeliveryCursor), nil
+}
+
+// AdvanceDeliveryCursor records that userID acknowledged every message up to messageID. The
+// cursor never moves back, so acks may arrive out of order.
+func (cs *ChatService) AdvanceDeliveryCursor(ctx context.Context, userID, messageID string) error {
+	id, err := strconv.Atoi(messageID)
+	if err != nil {
+		return ErrInvalidMessageID
+	}
+	_, err = cs.prismaClient.Message.FindFirst(
+		db.Message.ID.Equals(id),
+		db.Message.Or(
+			db.Message.SenderID.Equals(userID),
+			db.Message.ReceiverID.Equals(userID),
+		),
+	).Exec(ctx)
+	if errors.Is(err, db.ErrNotFound) {
+		return ErrInvalidMessageID
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = cs.prismaClient.User.FindMany(
+		db.User.ID.Equals(userID),
+		db.User.DeliveryCursor.Lt(id),
+	).Update(db.User.DeliveryCursor.Set(id)).Exec(ctx)
+	return err
+}
+
+// MarkReceipts records that readerID received (kind ReceiptDelivered) or read (ReceiptRead)
+// every message peerUsername sent them up to and including message upTo, or all of them if
+// upTo is empty. Read implies delivered. It returns the ID of the newest message covered,
+// empty if there was none.
+func (cs *ChatService) MarkReceipts(ctx context.Context, readerID, peerUsername, upTo, kind string) (string, error) {
+	peer, err := cs.prismaClient.User.FindUnique(
+		db.User.Username.Equals(utils.CanonicalUsername(peerUsername)),
+	).Exec(ctx)
+	if err != nil {
+		return "", ErrUnknownReceiver
+	}
+
+	params := []db.MessageWhereParam{
+		db.Message.SenderID.Equals(peer.ID),
+		db.Message.ReceiverID.Equals(readerID),
+	}
+	if upTo != "" {
+		id, err := strconv.Atoi(upTo)
+		if err != nil {
+			return "", ErrInvalidMessageID
+		}
+		params = append(params, db.Message.ID.Lte(id))
+	}
+	newest, err := cs.prismaClient.Message.FindFirst(params...).OrderBy(
+		db.Message.ID.Order(db.SortOrderDesc),
+	).Exec(ctx)
+	if errors.Is(err, db.ErrNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	params = append(params, db.Message.ID.Lte(newest.ID))
+
+	now := time.Now()
+	undelivered := append(slices.Clip(params), db.Message.DeliveredAt.IsNull())
+	txs := []transaction.Transaction{
+		cs.prismaClient.Message.FindMany(undelivered...).Update(db.Message.DeliveredAt.Set(now)).Tx(),
+	}
+	if kind == types.ReceiptRead {
+		unread := append(slices.Clip(params), db.Message.ReadAt.IsNull())
+		txs = append(txs, cs.prismaClient.Message.FindMany(unread...).Update(db.Message.ReadAt.Set(now)).Tx())
+	}
+	if err := cs.prismaClient.Prisma.Transaction(txs...).Exec(ctx); err != nil {
+		return "", err
+	}
+	return strconv.Itoa(newest.ID), nil
+}
+
+// ReceiptsSince returns the receipts of messages senderID sent that were delivered or read
+// after since, oldest message first.
+func (cs *ChatService) ReceiptsSince(ctx context.Context, senderID string, since time.Time) ([]types.Receipt, error) {
+	ms, err := cs.prismaClient.Message.FindMany(
+		db.Message.SenderID.Equals(senderID),
+		db.Message.Or(
+			db.Message.DeliveredAt.After(since),
+			db.Message.ReadAt.After(since),
+		),
+	).With(
+		db.Message.Receiver.Fetch(),
+	).OrderBy(db.Message.ID.Order(db.SortOrderAsc)).Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]types.Receipt, 0, len(ms))
+	for _, m := range ms {
+		receipt := types.Receipt{
+			MessageID:        strconv.Itoa(m.ID),
+			ReceiverUsername: m.Receiver().Username,
+		}
+		if t, ok := m.DeliveredAt(); ok {
+			receipt.DeliveredAt = t.Format(time.RFC3339)
+		}
+		if t, ok := m.ReadAt(); ok {
+			receipt.ReadAt = t.Format(time.RFC3339)
+		}
+		out = append(out, receipt)
+	}
+	return out, nil
+}
+
 func (cs *ChatService) GetChatMetadata(ctx *gin.Context, userId string) ([]types.ChatMetadata, error) {
     
 	query := `
@@ -0,0 +1,182 @@
+package services
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/prisma/db"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/types"
+)
+
+var (
+	ErrDeviceNotFound = errors.New("device not found")
+	ErrTooManyDevices = errors.New("device limit reached")
+)
+
+type DeviceService struct {
+	prismaClient *db.PrismaClient
+	authService  *AuthService
+	nonceStore   NonceStore
+	audit        *AuditService
+}
+
+func NewDeviceService(client *db.PrismaClient, authService *AuthService, nonceStore NonceStore, audit *AuditService) *DeviceService {
+	return &DeviceService{prismaClient: client, authService: authService, nonceStore: nonceStore, audit: audit}
+}
+
+// deviceChallengeKey keeps device challenges apart from login challenges in the nonce store.
+func deviceChallengeKey(username string) string {
+	return "device:" + username
+}
+
+func (ds *DeviceService) IssueDeviceChallenge(ctx *gin.Context, username string) (string, error) {
+	return ds.authService.IssueChallenge(ctx, deviceChallengeKey(username))
+}
+
+// DeviceStatement returns the hex encoded statement signed by both the new device key,
+// as proof of possession, and the account identity key, to vouch for the device.
+func DeviceStatement(username string, pk types.PublicKey, nonce string) string {
+	statement := strings.Join([]string{"device", username, pk.X, pk.Y, pk.Ecdh, nonce}, "|")
+	return hex.EncodeToString([]byte(statement))
+}
+
+// RegisterDevice adds a device to the account of user. Peers can check the stored account
+// signature against the user's identity key before encrypting to the device.
+func (ds *DeviceService) RegisterDevice(ctx *gin.Context, user *db.UserModel, req types.DeviceRegistrationRequest) (*db.DeviceModel, error) {
+	if err := ValidatePublicKey(req.PublicKeyHex); err != nil {
+		return nil, err
+	}
+
+	ok, err := ds.nonceStore.Take(ctx, deviceChallengeKey(user.Username), req.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to take challenge: %w", err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("no valid device challenge found")
+	}
+
+	statement := DeviceStatement(user.Username, req.PublicKeyHex, req.Nonce)
+	valid, err := ds.authService.VerifySignature(req.PublicKeyHex.X, req.PublicKeyHex.Y, statement, req.Signature)
+	if err != nil || !valid {
+		return nil, fmt.Errorf("device proof of possession signature is invalid")
+	}
+	valid, err = ds.authService.VerifySignature(user.PublicKeyX, user.PublicKeyY, statement, req.AccountSignature)
+	if err != nil || !valid {
+		return nil, fmt.Errorf("account signature is invalid")
+	}
+
+	active, err := ds.prismaClient.Device.FindMany(
+		db.Device.UserID.Equals(user.ID),
+		db.Device.RevokedAt.IsNull(),
+	).Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(active) >= types.MAX_DEVICES_PER_USER {
+		return nil, ErrTooManyDevices
+	}
+
+	params := []db.DeviceSetParam{}
+	if req.Name != "" {
+		params = append(params, db.Device.Name.Set(req.Name))
+	}
+	device, err := ds.prismaClient.Device.CreateOne(
+		db.Device.PublicKeyX.Set(req.PublicKeyHex.X),
+		db.Device.PublicKeyY.Set(req.PublicKeyHex.Y),
+		db.Device.PublicKeyEcdh.Set(req.PublicKeyHex.Ecdh),
+		db.Device.AccountSignatureR.Set(req.AccountSignature.R),
+		db.Device.AccountSignatureS.Set(req.AccountSignature.S),
+		db.Device.User.Link(db.User.ID.Equals(user.ID)),
+		params...,
+	).Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ds.audit.Record(ctx, types.AuditDeviceRegistered, user.ID, user.Username, map[string]interface{}{
+		"device_id": device.ID,
+	})
+	return device, nil
+}
+
+// ListDevices returns the active devices of username, oldest first.
+func (ds *DeviceService) ListDevices(ctx context.Context, username string) ([]types.Device, error) {
+	devices, err := ds.prismaClient.Device.FindMany(
+		db.Device.User.Where(db.User.Username.Equals(username)),
+		db.Device.RevokedAt.IsNull(),
+	).OrderBy(db.Device.CreatedAt.Order(db.SortOrderAsc)).Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]types.Device, 0, len(devices))
+	for i := range devices {
+		out = append(out, DeviceFromModel(&devices[i]))
+	}
+	return out, nil
+}
+
+// ActiveDevice returns the device deviceID if it belongs to userID and has not been revoked.
+func (ds *DeviceService) ActiveDevice(ctx context.Context, userID, deviceID string) (*db.DeviceModel, error) {
+	device, err := ds.prismaClient.Device.FindFirst(
+		db.Device.ID.Equals(deviceID),
+		db.Device.UserID.Equals(userID),
+		db.Device.RevokedAt.IsNull(),
+	).Exec(ctx)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, ErrDeviceNotFound
+	}
+	return device, err
+}
+
+func (ds *DeviceService) TouchDevice(ctx context.Context, deviceID string) error {
+	_, err := ds.prismaClient.Device.FindUnique(
+		db.Device.ID.Equals(deviceID),
+	).Update(
+		db.Device.LastSeenAt.Set(time.Now()),
+	).Exec(ctx)
+	return err
+}
+
+// RevokeDevice marks a device of user as revoked. Its keys stay stored so old messages remain verifiable.
+func (ds *DeviceService) RevokeDevice(ctx context.Context, user *db.UserModel, deviceID string) error {
+	res, err := ds.prismaClient.Device.FindMany(
+		db.Device.ID.Equals(deviceID),
+		db.Device.UserID.Equals(user.ID),
+		db.Device.RevokedAt.IsNull(),
+	).Update(
+		db.Device.RevokedAt.Set(time.Now()),
+	).Exec(ctx)
+	if err != nil {
+		return err
+	}
+	if res.Count == 0 {
+		return ErrDeviceNotFound
+	}
+	ds.audit.Record(ctx, types.AuditDeviceRevoked, user.ID, user.Username, map[string]interface{}{
+		"device_id": deviceID,
+	})
+	return nil
+}
+
+func DeviceFromModel(d *db.DeviceModel) types.Device {
+	device := types.Device{
+		ID: d.ID,
+		PublicKeyHex: types.PublicKey{
+			X:    d.PublicKeyX,
+			Y:    d.PublicKeyY,
+			Ecdh: d.PublicKeyEcdh,
+		},
+		AccountSignature: types.Signature{R: d.AccountSignatureR, S: d.AccountSignatureS},
+		CreatedAt:        d.CreatedAt.Format(time.RFC3339),
+	}
+	device.Name, _ = d.Name()
+	if v, ok := d.LastSeenAt(); ok {
+		device.LastSeenAt = v.Format(time.RFC3339)
+	}
+	return device
+}
@@ -0,0 +1,153 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/types"
+)
+
+// LoginLockedError is returned by ProcessLogin while a username is locked out for the client.
+type LoginLockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginLockedError) Error() string {
+	return fmt.Sprintf("too many failed login attempts, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+// LoginLockout counts failed login signatures per key, see LoginLockoutKey. Once the threshold
+// is reached every further failure locks the key out, each time twice as long as before.
+type LoginLockout interface {
+	// RetryAfter returns how long key is still locked out, or zero.
+	RetryAfter(ctx context.Context, key string) (time.Duration, error)
+	// Fail records a failed attempt and returns the lockout it triggered, if any.
+	Fail(ctx context.Context, key string) (time.Duration, error)
+	// Reset forgets the failures of key after a successful login.
+	Reset(ctx context.Context, key string) error
+	// PurgeStale forgets keys that are not locked and have not failed within the failure window.
+	PurgeStale(ctx context.Context) (int, error)
+}
+
+// LoginLockoutKey is the key failures of a login for username from the client address ip are
+// counted under. Keying on the address too keeps anyone else from locking a user out.
+func LoginLockoutKey(username, ip string) string {
+	return username + "|" + ip
+}
+
+// lockoutFor returns how long the count-th failure in a row locks a key out.
+func lockoutFor(count int) time.Duration {
+	if count < types.LOGIN_LOCKOUT_THRESHOLD {
+		return 0
+	}
+	lock := types.LOGIN_LOCKOUT_BASE
+	for i := types.LOGIN_LOCKOUT_THRESHOLD; i < count && lock < types.LOGIN_LOCKOUT_MAX; i++ {
+		lock *= 2
+	}
+	if lock > types.LOGIN_LOCKOUT_MAX {
+		lock = types.LOGIN_LOCKOUT_MAX
+	}
+	return lock
+}
+
+// MemoryLoginLockout is a LoginLockout that lives in process memory.
+// Failures are lost on restart and are counted per replica.
+type MemoryLoginLockout struct {
+	mu        sync.Mutex
+	failures  map[string]*loginFailures
+	lastSweep time.Time
+}
+
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+func NewMemoryLoginLockout() *MemoryLoginLockout {
+	return &MemoryLoginLockout{failures: make(map[string]*loginFailures)}
+}
+
+func (l *MemoryLoginLockout) RetryAfter(ctx context.Context, key string) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, ok := l.failures[key]
+	if !ok {
+		return 0, nil
+	}
+	if wait := time.Until(f.lockedUntil); wait > 0 {
+		return wait, nil
+	}
+	return 0, nil
+}
+
+func (l *MemoryLoginLockout) Fail(ctx context.Context, key string) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) >= time.Minute {
+		l.forgetStale(now)
+	}
+
+	f, ok := l.failures[key]
+	if !ok {
+		f = &loginFailures{}
+		l.failures[key] = f
+	}
+	f.count++
+	f.last = now
+	lock := lockoutFor(f.count)
+	if lock > 0 {
+		f.lockedUntil = now.Add(lock)
+	}
+	return lock, nil
+}
+
+func (l *MemoryLoginLockout) Reset(ctx context.Context, key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, key)
+	return nil
+}
+
+func (l *MemoryLoginLockout) PurgeStale(ctx context.Context) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.forgetStale(time.Now()), nil
+}
+
+// forgetStale drops keys that have not failed within the failure window. The caller must hold l.mu.
+func (l *MemoryLoginLockout) forgetStale(now time.Time) int {
+	l.lastSweep = now
+
+	removed := 0
+	for key, f := range l.failures {
+		if now.Sub(f.last) > types.LOGIN_FAILURE_WINDOW && now.After(f.lockedUntil) {
+			delete(l.failures, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// RunLockoutJanitor purges stale login failures from lockout every interval until ctx is cancelled.
+func RunLockoutJanitor(ctx context.Context, lockout LoginLockout, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := lockout.PurgeStale(ctx); err != nil {
+				log.Println("Failed to purge stale login failures:", err)
+			}
+		}
+	}
+}
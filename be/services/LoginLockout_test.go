@@ -0,0 +1,128 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/types"
+)
+
+// rewindLockout moves every record of l back in time by d, as if d had passed.
+func rewindLockout(l *MemoryLoginLockout, d time.Duration) {
+	for _, f := range l.failures {
+		f.last = f.last.Add(-d)
+		f.lockedUntil = f.lockedUntil.Add(-d)
+	}
+	l.lastSweep = l.lastSweep.Add(-d)
+}
+
+// fail records a failure for key, the memory lockout never returns an error.
+func fail(l *MemoryLoginLockout, key string) time.Duration {
+	lock, _ := l.Fail(context.Background(), key)
+	return lock
+}
+
+var aliceKey = LoginLockoutKey("alice", "203.0.113.7")
+
+func TestLoginLockoutProgression(t *testing.T) {
+	base := types.LOGIN_LOCKOUT_BASE
+	tests := []struct {
+		failure int
+		want    time.Duration
+	}{
+		{1, 0},
+		{types.LOGIN_LOCKOUT_THRESHOLD - 1, 0},
+		{types.LOGIN_LOCKOUT_THRESHOLD, base},
+		{types.LOGIN_LOCKOUT_THRESHOLD + 1, 2 * base},
+		{types.LOGIN_LOCKOUT_THRESHOLD + 2, 4 * base},
+		{types.LOGIN_LOCKOUT_THRESHOLD + 4, 16 * base},
+		{types.LOGIN_LOCKOUT_THRESHOLD + 5, types.LOGIN_LOCKOUT_MAX},
+		{types.LOGIN_LOCKOUT_THRESHOLD + 20, types.LOGIN_LOCKOUT_MAX},
+	}
+
+	l := NewMemoryLoginLockout()
+	failures := 0
+	for _, tt := range tests {
+		var got time.Duration
+		for failures < tt.failure {
+			got = fail(l, aliceKey)
+			failures++
+		}
+		if got != tt.want {
+			t.Errorf("failure %d locked for %s, want %s", tt.failure, got, tt.want)
+		}
+	}
+}
+
+func TestLoginLockoutRetryAfter(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		reset    bool
+		elapsed  time.Duration
+		key      string
+		wantLock bool
+	}{
+		{name: "below threshold", failures: types.LOGIN_LOCKOUT_THRESHOLD - 1},
+		{name: "at threshold", failures: types.LOGIN_LOCKOUT_THRESHOLD, wantLock: true},
+		{name: "lock expired", failures: types.LOGIN_LOCKOUT_THRESHOLD, elapsed: types.LOGIN_LOCKOUT_BASE + time.Second},
+		{name: "reset after success", failures: types.LOGIN_LOCKOUT_THRESHOLD, reset: true},
+		{name: "other usernames unaffected", failures: types.LOGIN_LOCKOUT_THRESHOLD, key: LoginLockoutKey("bob", "203.0.113.7")},
+		{name: "same username from another address unaffected", failures: types.LOGIN_LOCKOUT_THRESHOLD, key: LoginLockoutKey("alice", "198.51.100.2")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			l := NewMemoryLoginLockout()
+			for i := 0; i < tt.failures; i++ {
+				fail(l, aliceKey)
+			}
+			if tt.reset {
+				_ = l.Reset(ctx, aliceKey)
+			}
+			rewindLockout(l, tt.elapsed)
+
+			key := aliceKey
+			if tt.key != "" {
+				key = tt.key
+			}
+			wait, _ := l.RetryAfter(ctx, key)
+			if locked := wait > 0; locked != tt.wantLock {
+				t.Fatalf("RetryAfter(%q) = %s, locked = %v, want %v", key, wait, locked, tt.wantLock)
+			}
+			if tt.wantLock && wait > types.LOGIN_LOCKOUT_BASE {
+				t.Errorf("RetryAfter = %s, want at most %s", wait, types.LOGIN_LOCKOUT_BASE)
+			}
+		})
+	}
+}
+
+func TestLoginLockoutKeepsCountingAfterLockExpires(t *testing.T) {
+	l := NewMemoryLoginLockout()
+	for i := 0; i < types.LOGIN_LOCKOUT_THRESHOLD; i++ {
+		fail(l, aliceKey)
+	}
+	rewindLockout(l, types.LOGIN_LOCKOUT_BASE+time.Second)
+
+	if got := fail(l, aliceKey); got != 2*types.LOGIN_LOCKOUT_BASE {
+		t.Errorf("failure after an expired lock locked for %s, want %s", got, 2*types.LOGIN_LOCKOUT_BASE)
+	}
+}
+
+func TestLoginLockoutForgetsStaleFailures(t *testing.T) {
+	l := NewMemoryLoginLockout()
+	for i := 0; i < types.LOGIN_LOCKOUT_THRESHOLD-1; i++ {
+		fail(l, aliceKey)
+	}
+	rewindLockout(l, types.LOGIN_FAILURE_WINDOW+time.Minute)
+	fail(l, LoginLockoutKey("bob", "203.0.113.7"))
+
+	if _, ok := l.failures[aliceKey]; ok {
+		t.Fatal("failures outside the window were kept")
+	}
+	if got := fail(l, aliceKey); got != 0 {
+		t.Errorf("first failure after the window locked for %s", got)
+	}
+}
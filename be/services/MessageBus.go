@@ -0,0 +1,89 @@
+package services
+
+import (
+	"context"
+	"sync"
+)
+
+// Bus carries events between backend replicas. An event published to a channel reaches every
+// subscriber of that channel on any replica, the publishing one included, in the order the
+// events were published.
+type Bus interface {
+	// Publish sends payload to the subscribers of channel.
+	Publish(ctx context.Context, channel string, payload []byte) error
+	// Subscribe calls handler for every event on channel until the returned function is
+	// called. Handlers run on the publishing goroutine or on one of the bus and must not block.
+	Subscribe(channel string, handler func(payload []byte)) (unsubscribe func())
+}
+
+// busSubscribers keeps the handlers subscribed on this replica.
+type busSubscribers struct {
+	mu        sync.RWMutex
+	next      int
+	byChannel map[string]map[int]func([]byte)
+}
+
+func newBusSubscribers() *busSubscribers {
+	return &busSubscribers{byChannel: make(map[string]map[int]func([]byte))}
+}
+
+func (s *busSubscribers) Subscribe(channel string, handler func(payload []byte)) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := s.next
+	s.next++
+	handlers, ok := s.byChannel[channel]
+	if !ok {
+		handlers = make(map[int]func([]byte))
+		s.byChannel[channel] = handlers
+	}
+	handlers[id] = handler
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			delete(s.byChannel[channel], id)
+			if len(s.byChannel[channel]) == 0 {
+				delete(s.byChannel, channel)
+			}
+		})
+	}
+}
+
+func (s *busSubscribers) has(channel string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.byChannel[channel]) > 0
+}
+
+// dispatch calls the handlers of channel. They are called without the lock held, so a
+// handler may subscribe or unsubscribe.
+func (s *busSubscribers) dispatch(channel string, payload []byte) {
+	s.mu.RLock()
+	handlers := make([]func([]byte), 0, len(s.byChannel[channel]))
+	for _, h := range s.byChannel[channel] {
+		handlers = append(handlers, h)
+	}
+	s.mu.RUnlock()
+
+	for _, h := range handlers {
+		h(payload)
+	}
+}
+
+// MemoryBus is a Bus within a single process. It is enough as long as only one replica runs.
+type MemoryBus struct {
+	*busSubscribers
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{busSubscribers: newBusSubscribers()}
+}
+
+func (m *MemoryBus) Publish(ctx context.Context, channel string, payload []byte) error {
+	m.dispatch(channel, payload)
+	return nil
+}
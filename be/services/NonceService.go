@@ -1,50 +1,149 @@
 package services
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"fmt"
+	"log"
 	"sync"
 	"time"
-
 )
 
+// MaxOutstandingNonces limits how many unanswered challenges a single user can hold,
+// e.g. one per open tab or device. Further challenges are refused until one is answered or
+// expires; dropping the oldest instead would let anyone evict the challenge a user is answering.
+const MaxOutstandingNonces = 5
+
+// TooManyChallengesError is returned by NonceStore.Store when username already holds
+// MaxOutstandingNonces unexpired challenges. RetryAfter is when the oldest one expires.
+type TooManyChallengesError struct {
+	RetryAfter time.Duration
+}
+
+func (e *TooManyChallengesError) Error() string {
+	return fmt.Sprintf("too many outstanding challenges, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+// NonceStore keeps the login challenges issued by ReqChallenge until they are answered or expire.
+type NonceStore interface {
+	// Store saves a new challenge for username that stays valid for ttl. It returns a
+	// *TooManyChallengesError if username already holds MaxOutstandingNonces of them.
+	Store(ctx context.Context, username, nonce string, ttl time.Duration) error
+	// Take consumes the given challenge and reports whether it was issued to username and is still valid.
+	Take(ctx context.Context, username, nonce string) (bool, error)
+	// PurgeExpired removes every expired challenge and returns how many were removed.
+	PurgeExpired(ctx context.Context) (int, error)
+}
+
 type NonceData struct {
 	Value     string
 	ExpiresAt time.Time
 }
 
-var (
-	nonceStore = make(map[string]NonceData)
-	nonceMu    sync.Mutex
-)
+// MemoryNonceStore is a NonceStore that lives in process memory.
+// Challenges are lost on restart and are not shared between replicas.
+type MemoryNonceStore struct {
+	mu     sync.Mutex
+	nonces map[string][]NonceData
+}
 
-func StoreNonce(username, nonce string, ttl time.Duration) {
-	nonceMu.Lock()
-	defer nonceMu.Unlock()
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{
+		nonces: make(map[string][]NonceData),
+	}
+}
 
-	nonceStore[username] = NonceData{
+func (m *MemoryNonceStore) Store(ctx context.Context, username, nonce string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	list := m.nonces[username][:0]
+	for _, data := range m.nonces[username] {
+		if now.Before(data.ExpiresAt) {
+			list = append(list, data)
+		}
+	}
+	if len(list) >= MaxOutstandingNonces {
+		m.nonces[username] = list
+		oldest := list[0].ExpiresAt
+		for _, data := range list[1:] {
+			if data.ExpiresAt.Before(oldest) {
+				oldest = data.ExpiresAt
+			}
+		}
+		return &TooManyChallengesError{RetryAfter: oldest.Sub(now)}
+	}
+
+	m.nonces[username] = append(list, NonceData{
 		Value:     nonce,
-		ExpiresAt: time.Now().Add(ttl),
+		ExpiresAt: now.Add(ttl),
+	})
+	return nil
+}
+
+func (m *MemoryNonceStore) Take(ctx context.Context, username, nonce string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := m.nonces[username]
+	for i, data := range list {
+		if data.Value != nonce {
+			continue
+		}
+		list = append(list[:i], list[i+1:]...)
+		if len(list) == 0 {
+			delete(m.nonces, username)
+		} else {
+			m.nonces[username] = list
+		}
+		return time.Now().Before(data.ExpiresAt), nil
 	}
+	return false, nil
 }
 
-func TakeNonce(username string) (string, bool) {
-	nonceMu.Lock()
-	defer nonceMu.Unlock()
+func (m *MemoryNonceStore) PurgeExpired(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	data, ok := nonceStore[username]
-	if !ok {
-		return "", false
+	now := time.Now()
+	purged := 0
+	for username, list := range m.nonces {
+		kept := list[:0]
+		for _, data := range list {
+			if now.After(data.ExpiresAt) {
+				purged++
+				continue
+			}
+			kept = append(kept, data)
+		}
+		if len(kept) == 0 {
+			delete(m.nonces, username)
+		} else {
+			m.nonces[username] = kept
+		}
 	}
-	if time.Now().After(data.ExpiresAt) {
-		delete(nonceStore, username)
-		return "", false
+	return purged, nil
+}
+
+// RunNonceJanitor purges expired challenges from store every interval until ctx is cancelled.
+func RunNonceJanitor(ctx context.Context, store NonceStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := store.PurgeExpired(ctx); err != nil {
+				log.Println("Failed to purge expired nonces:", err)
+			}
+		}
 	}
-	delete(nonceStore, username)
-	return data.Value, true
 }
 
-	
 func GenerateNonce() (string, error) {
     randomBytes := make([]byte, 32) // 256-bit
     _, err := rand.Read(randomBytes)
@@ -52,4 +151,4 @@ func GenerateNonce() (string, error) {
         return "", err
     }
     return hex.EncodeToString(randomBytes), nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type nonceOp struct {
+	op       string // store, take or purge
+	username string
+	nonce    string
+	ttl      time.Duration
+	want     bool // result of take
+	purged   int  // result of purge
+}
+
+func storeOp(username, nonce string, ttl time.Duration) nonceOp {
+	return nonceOp{op: "store", username: username, nonce: nonce, ttl: ttl}
+}
+
+func takeOp(username, nonce string, want bool) nonceOp {
+	return nonceOp{op: "take", username: username, nonce: nonce, want: want}
+}
+
+func purgeOp(purged int) nonceOp {
+	return nonceOp{op: "purge", purged: purged}
+}
+
+func TestMemoryNonceStore(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  []nonceOp
+	}{
+		{"single use", []nonceOp{
+			storeOp("alice", "n1", time.Minute),
+			takeOp("alice", "n1", true),
+			takeOp("alice", "n1", false),
+		}},
+		{"unknown nonce", []nonceOp{
+			storeOp("alice", "n1", time.Minute),
+			takeOp("alice", "n2", false),
+			takeOp("alice", "n1", true),
+		}},
+		{"bound to the username", []nonceOp{
+			storeOp("alice", "n1", time.Minute),
+			takeOp("bob", "n1", false),
+			takeOp("alice", "n1", true),
+		}},
+		{"expired nonce is rejected and consumed", []nonceOp{
+			storeOp("alice", "n1", -time.Second),
+			takeOp("alice", "n1", false),
+			takeOp("alice", "n1", false),
+		}},
+		{"several outstanding nonces in any order", []nonceOp{
+			storeOp("alice", "n1", time.Minute),
+			storeOp("alice", "n2", time.Minute),
+			storeOp("alice", "n3", time.Minute),
+			takeOp("alice", "n2", true),
+			takeOp("alice", "n3", true),
+			takeOp("alice", "n1", true),
+		}},
+		{"purge removes only expired nonces", []nonceOp{
+			storeOp("alice", "fresh", time.Minute),
+			storeOp("alice", "old1", -time.Second),
+			storeOp("bob", "old2", -time.Second),
+			purgeOp(2),
+			takeOp("alice", "fresh", true),
+			purgeOp(0),
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runNonceOps(t, NewMemoryNonceStore(), tt.ops)
+		})
+	}
+}
+
+func TestMemoryNonceStoreRejectsBeyondLimit(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryNonceStore()
+	var ops []nonceOp
+	for i := 0; i < MaxOutstandingNonces; i++ {
+		ops = append(ops, storeOp("alice", fmt.Sprintf("n%d", i), time.Duration(i+1)*time.Minute))
+	}
+	runNonceOps(t, s, ops)
+
+	err := s.Store(ctx, "alice", "extra", time.Minute)
+	var tooMany *TooManyChallengesError
+	if !errors.As(err, &tooMany) {
+		t.Fatalf("Store beyond the limit = %v, want a *TooManyChallengesError", err)
+	}
+	if tooMany.RetryAfter <= 0 || tooMany.RetryAfter > time.Minute {
+		t.Errorf("RetryAfter = %s, want the time until the oldest challenge expires", tooMany.RetryAfter)
+	}
+
+	runNonceOps(t, s, []nonceOp{
+		takeOp("alice", "extra", false),
+		storeOp("bob", "b0", time.Minute),
+		takeOp("alice", "n0", true),
+		storeOp("alice", "n5", time.Minute),
+		takeOp("alice", "n1", true),
+		takeOp("alice", "n5", true),
+	})
+}
+
+func TestMemoryNonceStoreExpiredNoncesDoNotCount(t *testing.T) {
+	var ops []nonceOp
+	for i := 0; i < MaxOutstandingNonces; i++ {
+		ops = append(ops, storeOp("alice", fmt.Sprintf("old%d", i), -time.Second))
+	}
+	ops = append(ops, storeOp("alice", "fresh", time.Minute), takeOp("alice", "fresh", true))
+	runNonceOps(t, NewMemoryNonceStore(), ops)
+}
+
+func runNonceOps(t *testing.T, s NonceStore, ops []nonceOp) {
+	t.Helper()
+	ctx := context.Background()
+	for i, op := range ops {
+		switch op.op {
+		case "store":
+			if err := s.Store(ctx, op.username, op.nonce, op.ttl); err != nil {
+				t.Fatalf("op %d: Store: %v", i, err)
+			}
+		case "take":
+			ok, err := s.Take(ctx, op.username, op.nonce)
+			if err != nil {
+				t.Fatalf("op %d: Take: %v", i, err)
+			}
+			if ok != op.want {
+				t.Fatalf("op %d: Take(%q, %q) = %v, want %v", i, op.username, op.nonce, ok, op.want)
+			}
+		case "purge":
+			n, err := s.PurgeExpired(ctx)
+			if err != nil {
+				t.Fatalf("op %d: PurgeExpired: %v", i, err)
+			}
+			if n != op.purged {
+				t.Fatalf("op %d: PurgeExpired = %d, want %d", i, n, op.purged)
+			}
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/prisma/db"
+)
+
+// busPGChannel is the Postgres notification channel every bus channel is multiplexed onto.
+const busPGChannel = "chat_bus"
+
+// maxNotifyPayload stays below the 8000 byte limit Postgres puts on notification payloads.
+const maxNotifyPayload = 7900
+
+// BusEventRetention is how long payloads too large for a notification are kept.
+const BusEventRetention = time.Minute
+
+// busNotification is the payload of one notification. Payload is left out when the event
+// is stored in the bus_events table, Ref is then its ID.
+type busNotification struct {
+	Channel string `json:"c"`
+	Payload []byte `json:"p,omitempty"`
+	Ref     string `json:"r,omitempty"`
+}
+
+// PostgresBus is a Bus on top of Postgres LISTEN/NOTIFY, so events reach the subscribers of
+// every replica connected to the same database. Events are only received while Listen runs.
+type PostgresBus struct {
+	*busSubscribers
+	prismaClient *db.PrismaClient
+	connString   string
+}
+
+// NewPostgresBus creates a bus publishing through client. databaseURL is used for the
+// listening connection, which has to be a connection of its own.
+func NewPostgresBus(client *db.PrismaClient, databaseURL string) *PostgresBus {
+	return &PostgresBus{
+		busSubscribers: newBusSubscribers(),
+		prismaClient:   client,
+		connString:     pgxConnString(databaseURL),
+	}
+}
+
+// pgxConnString drops the query parameters only Prisma understands, Postgres would reject
+// them as unknown settings.
+func pgxConnString(databaseURL string) string {
+	u, err := url.Parse(databaseURL)
+	if err != nil {
+		return databaseURL
+	}
+	q := u.Query()
+	for _, key := range []string{"schema", "connection_limit", "pool_timeout", "pgbouncer", "socket_timeout"} {
+		q.Del(key)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func (b *PostgresBus) Publish(ctx context.Context, channel string, payload []byte) error {
+	encoded, err := json.Marshal(busNotification{Channel: channel, Payload: payload})
+	if err != nil {
+		return err
+	}
+	if len(encoded) > maxNotifyPayload {
+		event, err := b.prismaClient.BusEvent.CreateOne(
+			db.BusEvent.Channel.Set(channel),
+			db.BusEvent.Payload.Set(base64.StdEncoding.EncodeToString(payload)),
+		).Exec(ctx)
+		if err != nil {
+			return err
+		}
+		if encoded, err = json.Marshal(busNotification{Channel: channel, Ref: event.ID}); err != nil {
+			return err
+		}
+	}
+	_, err = b.prismaClient.Prisma.ExecuteRaw("SELECT pg_notify($1, $2)", busPGChannel, string(encoded)).Exec(ctx)
+	return err
+}
+
+// Listen receives notifications until ctx is cancelled and reconnects when the connection
+// drops. Events published while it is disconnected are lost.
+func (b *PostgresBus) Listen(ctx context.Context) {
+	backoff := time.Second
+	for {
+		connected, err := b.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = time.Second
+		}
+		log.Printf("Message bus listener disconnected, retrying in %s: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+func (b *PostgresBus) listen(ctx context.Context) (bool, error) {
+	conn, err := pgx.Connect(ctx, b.connString)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+busPGChannel); err != nil {
+		return false, err
+	}
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return true, err
+		}
+		b.receive(ctx, n.Payload)
+	}
+}
+
+func (b *PostgresBus) receive(ctx context.Context, raw string) {
+	var n busNotification
+	if err := json.Unmarshal([]byte(raw), &n); err != nil {
+		log.Println("Dropping malformed bus notification:", err)
+		return
+	}
+	if !b.has(n.Channel) {
+		return
+	}
+
+	payload := n.Payload
+	if n.Ref != "" {
+		event, err := b.prismaClient.BusEvent.FindUnique(db.BusEvent.ID.Equals(n.Ref)).Exec(ctx)
+		if err != nil {
+			log.Printf("Failed to load bus event %s: %v", n.Ref, err)
+			return
+		}
+		if payload, err = base64.StdEncoding.DecodeString(event.Payload); err != nil {
+			log.Printf("Failed to decode bus event %s: %v", n.Ref, err)
+			return
+		}
+	}
+	b.dispatch(n.Channel, payload)
+}
+
+// PurgeExpired removes stored events older than BusEventRetention and returns how many were removed.
+func (b *PostgresBus) PurgeExpired(ctx context.Context) (int, error) {
+	res, err := b.prismaClient.BusEvent.FindMany(
+		db.BusEvent.CreatedAt.Before(time.Now().Add(-BusEventRetention)),
+	).Delete().Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return res.Count, nil
+}
+
+// RunBusJanitor purges expired stored events from bus every interval until ctx is cancelled.
+func RunBusJanitor(ctx context.Context, bus *PostgresBus, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := bus.PurgeExpired(ctx); err != nil {
+				log.Println("Failed to purge expired bus events:", err)
+			}
+		}
+	}
+}
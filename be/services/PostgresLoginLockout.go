@@ -0,0 +1,105 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/prisma/db"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/types"
+)
+
+// PostgresLoginLockout is a LoginLockout backed by the login_failures table,
+// so failures survive restarts and are counted across every replica.
+type PostgresLoginLockout struct {
+	prismaClient *db.PrismaClient
+}
+
+func NewPostgresLoginLockout(client *db.PrismaClient) *PostgresLoginLockout {
+	return &PostgresLoginLockout{prismaClient: client}
+}
+
+func (p *PostgresLoginLockout) RetryAfter(ctx context.Context, key string) (time.Duration, error) {
+	f, err := p.prismaClient.LoginFailure.FindUnique(
+		db.LoginFailure.Key.Equals(key),
+	).Exec(ctx)
+	if errors.Is(err, db.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if lockedUntil, ok := f.LockedUntil(); ok {
+		if wait := time.Until(lockedUntil); wait > 0 {
+			return wait, nil
+		}
+	}
+	return 0, nil
+}
+
+func (p *PostgresLoginLockout) Fail(ctx context.Context, key string) (time.Duration, error) {
+	now := time.Now()
+	// failures outside the window start counting from scratch
+	_, err := p.prismaClient.LoginFailure.FindMany(
+		db.LoginFailure.Key.Equals(key),
+		db.LoginFailure.LastFailedAt.Before(now.Add(-types.LOGIN_FAILURE_WINDOW)),
+		db.LoginFailure.Or(
+			db.LoginFailure.LockedUntil.IsNull(),
+			db.LoginFailure.LockedUntil.Before(now),
+		),
+	).Delete().Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// the increment happens in the database, so concurrent failures on other replicas all count
+	f, err := p.prismaClient.LoginFailure.UpsertOne(
+		db.LoginFailure.Key.Equals(key),
+	).Create(
+		db.LoginFailure.Key.Set(key),
+		db.LoginFailure.Count.Set(1),
+		db.LoginFailure.LastFailedAt.Set(now),
+	).Update(
+		db.LoginFailure.Count.Increment(1),
+		db.LoginFailure.LastFailedAt.Set(now),
+	).Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	lock := lockoutFor(f.Count)
+	if lock == 0 {
+		return 0, nil
+	}
+	_, err = p.prismaClient.LoginFailure.FindUnique(
+		db.LoginFailure.Key.Equals(key),
+	).Update(
+		db.LoginFailure.LockedUntil.Set(now.Add(lock)),
+	).Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return lock, nil
+}
+
+func (p *PostgresLoginLockout) Reset(ctx context.Context, key string) error {
+	_, err := p.prismaClient.LoginFailure.FindMany(
+		db.LoginFailure.Key.Equals(key),
+	).Delete().Exec(ctx)
+	return err
+}
+
+func (p *PostgresLoginLockout) PurgeStale(ctx context.Context) (int, error) {
+	now := time.Now()
+	res, err := p.prismaClient.LoginFailure.FindMany(
+		db.LoginFailure.LastFailedAt.Before(now.Add(-types.LOGIN_FAILURE_WINDOW)),
+		db.LoginFailure.Or(
+			db.LoginFailure.LockedUntil.IsNull(),
+			db.LoginFailure.LockedUntil.Before(now),
+		),
+	).Delete().Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return res.Count, nil
+}
@@ -0,0 +1,65 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/prisma/db"
+)
+
+// PostgresNonceStore is a NonceStore backed by the auth_challenges table,
+// so challenges survive restarts and are shared by every replica.
+type PostgresNonceStore struct {
+	prismaClient *db.PrismaClient
+}
+
+func NewPostgresNonceStore(client *db.PrismaClient) *PostgresNonceStore {
+	return &PostgresNonceStore{prismaClient: client}
+}
+
+func (p *PostgresNonceStore) Store(ctx context.Context, username, nonce string, ttl time.Duration) error {
+	now := time.Now()
+	outstanding, err := p.prismaClient.AuthChallenge.FindMany(
+		db.AuthChallenge.Username.Equals(username),
+		db.AuthChallenge.ExpiresAt.After(now),
+	).OrderBy(
+		db.AuthChallenge.ExpiresAt.Order(db.SortOrderAsc),
+	).Take(MaxOutstandingNonces).Exec(ctx)
+	if err != nil {
+		return err
+	}
+	if len(outstanding) >= MaxOutstandingNonces {
+		return &TooManyChallengesError{RetryAfter: outstanding[0].ExpiresAt.Sub(now)}
+	}
+
+	_, err = p.prismaClient.AuthChallenge.CreateOne(
+		db.AuthChallenge.Username.Set(username),
+		db.AuthChallenge.Nonce.Set(nonce),
+		db.AuthChallenge.ExpiresAt.Set(now.Add(ttl)),
+	).Exec(ctx)
+	return err
+}
+
+func (p *PostgresNonceStore) Take(ctx context.Context, username, nonce string) (bool, error) {
+	// deleting and counting in one statement makes a challenge usable exactly once,
+	// even when two replicas receive the same login at the same time
+	res, err := p.prismaClient.AuthChallenge.FindMany(
+		db.AuthChallenge.Username.Equals(username),
+		db.AuthChallenge.Nonce.Equals(nonce),
+		db.AuthChallenge.ExpiresAt.After(time.Now()),
+	).Delete().Exec(ctx)
+	if err != nil {
+		return false, err
+	}
+	return res.Count > 0, nil
+}
+
+func (p *PostgresNonceStore) PurgeExpired(ctx context.Context) (int, error) {
+	res, err := p.prismaClient.AuthChallenge.FindMany(
+		db.AuthChallenge.ExpiresAt.Before(time.Now()),
+	).Delete().Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return res.Count, nil
+}
@@ -0,0 +1,119 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/prisma/db"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/types"
+)
+
+// userPresence holds the open connections of one user and whether each of them is away.
+type userPresence struct {
+	userID string
+	away   map[string]bool // connection ID -> away
+}
+
+func (p *userPresence) status() string {
+	for _, away := range p.away {
+		if !away {
+			return types.PresenceOnline
+		}
+	}
+	return types.PresenceAway
+}
+
+// PresenceService tracks who is connected to this server. A user is online while any of their
+// connections is active, away when all of them are idle and offline once the last one closes,
+// at which point last seen is stored.
+type PresenceService struct {
+	prismaClient *db.PrismaClient
+	mu           sync.Mutex
+	users        map[string]*userPresence // username -> presence
+}
+
+func NewPresenceService(client *db.PrismaClient) *PresenceService {
+	return &PresenceService{
+		prismaClient: client,
+		users:        make(map[string]*userPresence),
+	}
+}
+
+// Connect registers connection connID of username and reports whether their status changed.
+func (ps *PresenceService) Connect(username, userID, connID string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	p, ok := ps.users[username]
+	if !ok {
+		p = &userPresence{userID: userID, away: map[string]bool{}}
+		ps.users[username] = p
+	}
+	before := p.status()
+	p.away[connID] = false
+	return !ok || p.status() != before
+}
+
+// Disconnect removes connection connID and reports whether username's status changed. When
+// the last connection closes the user goes offline and last seen is stored.
+func (ps *PresenceService) Disconnect(ctx context.Context, username, connID string) (bool, error) {
+	ps.mu.Lock()
+	p, ok := ps.users[username]
+	if !ok {
+		ps.mu.Unlock()
+		return false, nil
+	}
+	before := p.status()
+	delete(p.away, connID)
+	if len(p.away) > 0 {
+		changed := p.status() != before
+		ps.mu.Unlock()
+		return changed, nil
+	}
+	delete(ps.users, username)
+	ps.mu.Unlock()
+
+	_, err := ps.prismaClient.User.FindUnique(
+		db.User.ID.Equals(p.userID),
+	).Update(
+		db.User.LastSeenAt.Set(time.Now()),
+	).Exec(ctx)
+	return true, err
+}
+
+// SetAway marks connection connID as idle or active and reports whether username's status changed.
+func (ps *PresenceService) SetAway(username, connID string, away bool) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	p, ok := ps.users[username]
+	if !ok {
+		return false
+	}
+	if _, ok := p.away[connID]; !ok {
+		return false
+	}
+	before := p.status()
+	p.away[connID] = away
+	return p.status() != before
+}
+
+// Presence returns what friends see of user.
+func (ps *PresenceService) Presence(user *db.UserModel) types.Presence {
+	ps.mu.Lock()
+	p, ok := ps.users[user.Username]
+	status := types.PresenceOffline
+	if ok {
+		status = p.status()
+	}
+	ps.mu.Unlock()
+
+	presence := types.Presence{Username: user.Username, Status: status}
+	if status == types.PresenceOffline && !user.HideLastSeen {
+		if t, ok := user.LastSeenAt(); ok {
+			presence.LastSeen = t.Format(time.RFC3339)
+		}
+	}
+	return presence
+}
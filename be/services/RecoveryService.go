@@ -0,0 +1,508 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/prisma/db"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/types"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/utils"
+	"github.com/steebchen/prisma-client-go/runtime/transaction"
+)
+
+var (
+	ErrRecoveryNotConfigured    = errors.New("recovery is not set up for this account")
+	ErrRecoveryRequestNotFound  = errors.New("recovery request not found")
+	ErrRecoveryNotGuardian      = errors.New("not a guardian of this account")
+	ErrRecoveryAlreadyApproved  = errors.New("recovery request already approved")
+	ErrRecoveryThresholdNotMet  = errors.New("not enough guardians approved the recovery")
+	ErrRecoveryInvalidSignature = errors.New("recovery signature is invalid")
+	ErrRecoveryTooManyRequests  = errors.New("too many open recovery requests for this account")
+)
+
+// RecoveryService implements social recovery. The client encrypts a recovery secret, splits
+// the key into Shamir shares and encrypts each share to a friend. To recover, a new client
+// opens a request with a fresh identity key and an ephemeral ECDH key. Guardians re-encrypt
+// their share to the ephemeral key and sign an approval; once threshold approvals are in, the
+// client can rebuild the secret and the account key is reset to the requested one.
+type RecoveryService struct {
+	prismaClient *db.PrismaClient
+	authService  *AuthService
+	audit        *AuditService
+}
+
+func NewRecoveryService(client *db.PrismaClient, authService *AuthService, audit *AuditService) *RecoveryService {
+	return &RecoveryService{prismaClient: client, authService: authService, audit: audit}
+}
+
+// RecoveryRequestStatement is signed with the requested new key as proof of possession.
+func RecoveryRequestStatement(username string, newKey types.PublicKey, ephemeralKey string) string {
+	statement := strings.Join([]string{"recovery-request", username, newKey.X, newKey.Y, newKey.Ecdh, ephemeralKey}, "|")
+	return hex.EncodeToString([]byte(statement))
+}
+
+// RecoveryApprovalStatement is signed by a guardian's identity key to approve a request.
+func RecoveryApprovalStatement(requestID, username string, newKey types.PublicKey, ephemeralKey string, shareIndex int) string {
+	statement := strings.Join([]string{"recovery-approve", requestID, username, newKey.X, newKey.Y, newKey.Ecdh, ephemeralKey, strconv.Itoa(shareIndex)}, "|")
+	return hex.EncodeToString([]byte(statement))
+}
+
+func hashRecoveryToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (rs *RecoveryService) areFriends(ctx context.Context, a, b string) (bool, error) {
+	if a > b {
+		a, b = b, a
+	}
+	_, err := rs.prismaClient.UserFriend.FindUnique(
+		db.UserFriend.User1IDUser2ID(
+			db.UserFriend.User1ID.Equals(a),
+			db.UserFriend.User2ID.Equals(b),
+		),
+	).Exec(ctx)
+	if errors.Is(err, db.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// SetupRecovery replaces the recovery configuration of user. Every guardian must be a friend
+// and hold exactly one share. Pending recovery requests are cancelled.
+func (rs *RecoveryService) SetupRecovery(ctx context.Context, user *db.UserModel, req types.RecoverySetupRequest) (*db.RecoveryConfigModel, error) {
+	if len(req.Shares) > types.MAX_RECOVERY_GUARDIANS {
+		return nil, fmt.Errorf("at most %d guardians are allowed", types.MAX_RECOVERY_GUARDIANS)
+	}
+	if req.Threshold < types.MIN_RECOVERY_THRESHOLD || req.Threshold > len(req.Shares) {
+		return nil, fmt.Errorf("threshold must be between %d and the number of guardians", types.MIN_RECOVERY_THRESHOLD)
+	}
+	if req.EncryptedSecret == "" {
+		return nil, fmt.Errorf("encrypted secret is required")
+	}
+
+	configID := uuid.NewString()
+	shares := make([]transaction.Transaction, 0, len(req.Shares))
+	seenGuardians := map[string]bool{}
+	seenIndexes := map[int]bool{}
+	for _, share := range req.Shares {
+		if share.Ciphertext == "" || share.ShareIndex < 1 || share.ShareIndex > 255 || seenIndexes[share.ShareIndex] {
+			return nil, fmt.Errorf("invalid share for guardian %q", share.GuardianUsername)
+		}
+		seenIndexes[share.ShareIndex] = true
+
+		guardian, err := rs.prismaClient.User.FindUnique(
+			db.User.Username.Equals(utils.CanonicalUsername(share.GuardianUsername)),
+		).Exec(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("guardian %q not found", share.GuardianUsername)
+		}
+		if guardian.ID == user.ID || seenGuardians[guardian.ID] {
+			return nil, fmt.Errorf("guardian %q can not hold a share", share.GuardianUsername)
+		}
+		seenGuardians[guardian.ID] = true
+
+		friends, err := rs.areFriends(ctx, user.ID, guardian.ID)
+		if err != nil {
+			return nil, err
+		}
+		if !friends {
+			return nil, fmt.Errorf("guardian %q is not a friend", share.GuardianUsername)
+		}
+
+		shares = append(shares, rs.prismaClient.RecoveryShare.CreateOne(
+			db.RecoveryShare.ShareIndex.Set(share.ShareIndex),
+			db.RecoveryShare.Ciphertext.Set(share.Ciphertext),
+			db.RecoveryShare.Config.Link(db.RecoveryConfig.ID.Equals(configID)),
+			db.RecoveryShare.Guardian.Link(db.User.ID.Equals(guardian.ID)),
+		).Tx())
+	}
+
+	created := rs.prismaClient.RecoveryConfig.CreateOne(
+		db.RecoveryConfig.Threshold.Set(req.Threshold),
+		db.RecoveryConfig.EncryptedSecret.Set(req.EncryptedSecret),
+		db.RecoveryConfig.User.Link(db.User.ID.Equals(user.ID)),
+		db.RecoveryConfig.ID.Set(configID),
+	).Tx()
+
+	txs := []transaction.Transaction{
+		rs.prismaClient.RecoveryConfig.FindMany(
+			db.RecoveryConfig.UserID.Equals(user.ID),
+		).Delete().Tx(),
+		rs.cancelPending(user.ID),
+		created,
+	}
+	txs = append(txs, shares...)
+	if err := rs.prismaClient.Prisma.Transaction(txs...).Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to store recovery configuration: %w", err)
+	}
+	rs.audit.Record(ctx, types.AuditRecoveryConfigured, user.ID, user.Username, map[string]interface{}{
+		"threshold": req.Threshold,
+		"guardians": len(req.Shares),
+	})
+	return created.Result(), nil
+}
+
+// completeIfPending marks a pending request completed. A many-update that matches no row
+// does not fail a transaction, so the statement divides by the number of rows it updated
+// to abort the transaction it is part of when the request was no longer pending.
+func (rs *RecoveryService) completeIfPending(requestID string) transaction.Transaction {
+	return rs.prismaClient.Prisma.ExecuteRaw(
+		`WITH completed AS (
+			UPDATE "recovery_requests" SET "status" = $2, "completedAt" = now()
+			WHERE "id" = $1 AND "status" = $3 AND "expiresAt" > now()
+			RETURNING 1
+		)
+		SELECT 1 / COUNT(*) FROM completed`,
+		requestID, types.RecoveryStatusCompleted, types.RecoveryStatusPending,
+	).Tx()
+}
+
+func (rs *RecoveryService) cancelPending(userID string) transaction.Transaction {
+	return rs.prismaClient.RecoveryRequest.FindMany(
+		db.RecoveryRequest.UserID.Equals(userID),
+		db.RecoveryRequest.Status.Equals(types.RecoveryStatusPending),
+	).Update(
+		db.RecoveryRequest.Status.Set(types.RecoveryStatusCancelled),
+	).Tx()
+}
+
+func (rs *RecoveryService) GetRecoveryConfig(ctx context.Context, userID string) (types.RecoveryConfigInfo, error) {
+	config, err := rs.prismaClient.RecoveryConfig.FindUnique(
+		db.RecoveryConfig.UserID.Equals(userID),
+	).With(
+		db.RecoveryConfig.Shares.Fetch().With(db.RecoveryShare.Guardian.Fetch()),
+	).Exec(ctx)
+	if errors.Is(err, db.ErrNotFound) {
+		return types.RecoveryConfigInfo{}, ErrRecoveryNotConfigured
+	}
+	if err != nil {
+		return types.RecoveryConfigInfo{}, err
+	}
+
+	info := types.RecoveryConfigInfo{
+		Threshold: config.Threshold,
+		Guardians: []string{},
+		CreatedAt: config.CreatedAt.Format(time.RFC3339),
+	}
+	for _, share := range config.Shares() {
+		info.Guardians = append(info.Guardians, share.Guardian().Username)
+	}
+	return info, nil
+}
+
+// DeleteRecovery removes the recovery configuration and cancels pending requests.
+func (rs *RecoveryService) DeleteRecovery(ctx context.Context, userID string) error {
+	return rs.prismaClient.Prisma.Transaction(
+		rs.prismaClient.RecoveryConfig.FindMany(
+			db.RecoveryConfig.UserID.Equals(userID),
+		).Delete().Tx(),
+		rs.cancelPending(userID),
+	).Exec(ctx)
+}
+
+// StartRecovery opens a recovery request for req.Username and returns the request together
+// with the usernames of the guardians that have to approve it. The returned token is the only
+// credential of the recovering client, only its hash is stored. Anyone can open a request, so
+// it leaves other open requests alone and at most MAX_OPEN_RECOVERY_REQUESTS can be open.
+func (rs *RecoveryService) StartRecovery(ctx context.Context, req types.RecoveryStartRequest) (types.RecoveryStartResponse, []string, error) {
+	user, err := rs.prismaClient.User.FindUnique(
+		db.User.Username.Equals(req.Username),
+	).With(
+		db.User.RecoveryConfig.Fetch().With(
+			db.RecoveryConfig.Shares.Fetch().With(db.RecoveryShare.Guardian.Fetch()),
+		),
+	).Exec(ctx)
+	if err != nil {
+		return types.RecoveryStartResponse{}, nil, ErrRecoveryNotConfigured
+	}
+	config, ok := user.RecoveryConfig()
+	if !ok {
+		return types.RecoveryStartResponse{}, nil, ErrRecoveryNotConfigured
+	}
+
+	if err := ValidatePublicKey(req.PublicKeyHex); err != nil {
+		return types.RecoveryStartResponse{}, nil, fmt.Errorf("invalid new public key: %w", err)
+	}
+	if err := utils.ValidateCompressedP256(req.EphemeralKey); err != nil {
+		return types.RecoveryStartResponse{}, nil, fmt.Errorf("invalid ephemeral key: %w", err)
+	}
+	statement := RecoveryRequestStatement(user.Username, req.PublicKeyHex, req.EphemeralKey)
+	valid, err := rs.authService.VerifySignature(req.PublicKeyHex.X, req.PublicKeyHex.Y, statement, req.Signature)
+	if err != nil || !valid {
+		return types.RecoveryStartResponse{}, nil, ErrRecoveryInvalidSignature
+	}
+
+	open, err := rs.prismaClient.RecoveryRequest.FindMany(
+		db.RecoveryRequest.UserID.Equals(user.ID),
+		db.RecoveryRequest.Status.Equals(types.RecoveryStatusPending),
+		db.RecoveryRequest.ExpiresAt.After(time.Now()),
+	).Exec(ctx)
+	if err != nil {
+		return types.RecoveryStartResponse{}, nil, err
+	}
+	if len(open) >= types.MAX_OPEN_RECOVERY_REQUESTS {
+		return types.RecoveryStartResponse{}, nil, ErrRecoveryTooManyRequests
+	}
+
+	token, err := GenerateNonce()
+	if err != nil {
+		return types.RecoveryStartResponse{}, nil, err
+	}
+	expiresAt := time.Now().Add(types.RECOVERY_REQUEST_TTL)
+
+	created, err := rs.prismaClient.RecoveryRequest.CreateOne(
+		db.RecoveryRequest.TokenHash.Set(hashRecoveryToken(token)),
+		db.RecoveryRequest.EphemeralKey.Set(req.EphemeralKey),
+		db.RecoveryRequest.NewPublicKeyX.Set(req.PublicKeyHex.X),
+		db.RecoveryRequest.NewPublicKeyY.Set(req.PublicKeyHex.Y),
+		db.RecoveryRequest.NewPublicKeyEcdh.Set(req.PublicKeyHex.Ecdh),
+		db.RecoveryRequest.ExpiresAt.Set(expiresAt),
+		db.RecoveryRequest.User.Link(db.User.ID.Equals(user.ID)),
+	).Exec(ctx)
+	if err != nil {
+		return types.RecoveryStartResponse{}, nil, fmt.Errorf("failed to open recovery request: %w", err)
+	}
+
+	rs.audit.Record(ctx, types.AuditRecoveryRequested, user.ID, user.Username, map[string]interface{}{
+		"request_id": created.ID,
+	})
+
+	guardians := make([]string, 0, len(config.Shares()))
+	for _, share := range config.Shares() {
+		guardians = append(guardians, share.Guardian().Username)
+	}
+	return types.RecoveryStartResponse{
+		RequestID: created.ID,
+		Token:     token,
+		ExpiresAt: expiresAt.Format(time.RFC3339),
+	}, guardians, nil
+}
+
+// ListGuardianRequests returns the pending requests of accounts guardianID holds a share for.
+func (rs *RecoveryService) ListGuardianRequests(ctx context.Context, guardianID string) ([]types.GuardianRecoveryRequest, error) {
+	shares, err := rs.prismaClient.RecoveryShare.FindMany(
+		db.RecoveryShare.GuardianID.Equals(guardianID),
+	).With(
+		db.RecoveryShare.Config.Fetch().With(db.RecoveryConfig.User.Fetch()),
+	).Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []types.GuardianRecoveryRequest{}
+	for _, share := range shares {
+		owner := share.Config().User()
+		requests, err := rs.prismaClient.RecoveryRequest.FindMany(
+			db.RecoveryRequest.UserID.Equals(owner.ID),
+			db.RecoveryRequest.Status.Equals(types.RecoveryStatusPending),
+			db.RecoveryRequest.ExpiresAt.After(time.Now()),
+		).Exec(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, request := range requests {
+			out = append(out, types.GuardianRecoveryRequest{
+				RequestID:    request.ID,
+				Username:     owner.Username,
+				EphemeralKey: request.EphemeralKey,
+				PublicKeyHex: types.PublicKey{
+					X:    request.NewPublicKeyX,
+					Y:    request.NewPublicKeyY,
+					Ecdh: request.NewPublicKeyEcdh,
+				},
+				ShareIndex: share.ShareIndex,
+				Ciphertext: share.Ciphertext,
+				CreatedAt:  request.CreatedAt.Format(time.RFC3339),
+				ExpiresAt:  request.ExpiresAt.Format(time.RFC3339),
+			})
+		}
+	}
+	return out, nil
+}
+
+// pendingRequest loads a request that can still be approved or completed.
+func (rs *RecoveryService) pendingRequest(ctx context.Context, requestID string) (*db.RecoveryRequestModel, error) {
+	request, err := rs.prismaClient.RecoveryRequest.FindFirst(
+		db.RecoveryRequest.ID.Equals(requestID),
+		db.RecoveryRequest.Status.Equals(types.RecoveryStatusPending),
+		db.RecoveryRequest.ExpiresAt.After(time.Now()),
+	).With(
+		db.RecoveryRequest.User.Fetch().With(db.User.RecoveryConfig.Fetch()),
+	).Exec(ctx)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, ErrRecoveryRequestNotFound
+	}
+	return request, err
+}
+
+// ApproveRecovery stores the share guardian re-encrypted to the request's ephemeral key.
+// It returns the username of the account being recovered.
+func (rs *RecoveryService) ApproveRecovery(ctx context.Context, guardian *db.UserModel, requestID string, req types.RecoveryApproveRequest) (string, error) {
+	request, err := rs.pendingRequest(ctx, requestID)
+	if err != nil {
+		return "", err
+	}
+	owner := request.User()
+	config, ok := owner.RecoveryConfig()
+	if !ok {
+		return "", ErrRecoveryNotConfigured
+	}
+
+	share, err := rs.prismaClient.RecoveryShare.FindUnique(
+		db.RecoveryShare.ConfigIDGuardianID(
+			db.RecoveryShare.ConfigID.Equals(config.ID),
+			db.RecoveryShare.GuardianID.Equals(guardian.ID),
+		),
+	).Exec(ctx)
+	if errors.Is(err, db.ErrNotFound) {
+		return "", ErrRecoveryNotGuardian
+	}
+	if err != nil {
+		return "", err
+	}
+	// guardians are chosen among friends, one that was removed since no longer vouches for the owner
+	friends, err := rs.areFriends(ctx, owner.ID, guardian.ID)
+	if err != nil {
+		return "", err
+	}
+	if !friends {
+		return "", ErrRecoveryNotGuardian
+	}
+	if req.Ciphertext == "" {
+		return "", fmt.Errorf("re-encrypted share is required")
+	}
+
+	newKey := types.PublicKey{X: request.NewPublicKeyX, Y: request.NewPublicKeyY, Ecdh: request.NewPublicKeyEcdh}
+	statement := RecoveryApprovalStatement(request.ID, owner.Username, newKey, request.EphemeralKey, share.ShareIndex)
+	valid, err := rs.authService.VerifySignature(guardian.PublicKeyX, guardian.PublicKeyY, statement, req.Signature)
+	if err != nil || !valid {
+		return "", ErrRecoveryInvalidSignature
+	}
+
+	_, err = rs.prismaClient.RecoveryApproval.CreateOne(
+		db.RecoveryApproval.ShareIndex.Set(share.ShareIndex),
+		db.RecoveryApproval.Ciphertext.Set(req.Ciphertext),
+		db.RecoveryApproval.SignatureR.Set(req.Signature.R),
+		db.RecoveryApproval.SignatureS.Set(req.Signature.S),
+		db.RecoveryApproval.Request.Link(db.RecoveryRequest.ID.Equals(request.ID)),
+		db.RecoveryApproval.Guardian.Link(db.User.ID.Equals(guardian.ID)),
+	).Exec(ctx)
+	if _, ok := db.IsErrUniqueConstraint(err); ok {
+		return "", ErrRecoveryAlreadyApproved
+	}
+	if err != nil {
+		return "", err
+	}
+	rs.audit.Record(ctx, types.AuditRecoveryApproved, owner.ID, owner.Username, map[string]interface{}{
+		"request_id": request.ID,
+		"guardian":   guardian.Username,
+	})
+	return owner.Username, nil
+}
+
+// requestByToken loads any request, whatever its status, if token belongs to it.
+func (rs *RecoveryService) requestByToken(ctx context.Context, requestID, token string) (*db.RecoveryRequestModel, error) {
+	request, err := rs.prismaClient.RecoveryRequest.FindUnique(
+		db.RecoveryRequest.ID.Equals(requestID),
+	).With(
+		db.RecoveryRequest.User.Fetch().With(db.User.RecoveryConfig.Fetch()),
+		db.RecoveryRequest.Approvals.Fetch().With(db.RecoveryApproval.Guardian.Fetch()),
+	).Exec(ctx)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, ErrRecoveryRequestNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(request.TokenHash), []byte(hashRecoveryToken(token))) != 1 {
+		return nil, ErrRecoveryRequestNotFound
+	}
+	return request, nil
+}
+
+// RecoveryStatus reports the progress of a request. Once enough guardians approved, the
+// encrypted secret and the re-encrypted shares are included so the client can rebuild it.
+func (rs *RecoveryService) RecoveryStatus(ctx context.Context, requestID, token string) (types.RecoveryStatus, error) {
+	request, err := rs.requestByToken(ctx, requestID, token)
+	if err != nil {
+		return types.RecoveryStatus{}, err
+	}
+
+	status := types.RecoveryStatus{
+		RequestID: request.ID,
+		Status:    request.Status,
+		Approvals: len(request.Approvals()),
+		ExpiresAt: request.ExpiresAt.Format(time.RFC3339),
+	}
+	config, ok := request.User().RecoveryConfig()
+	if !ok {
+		return status, nil
+	}
+	status.Threshold = config.Threshold
+
+	if request.Status == types.RecoveryStatusPending && status.Approvals >= config.Threshold {
+		status.EncryptedSecret = config.EncryptedSecret
+		for _, approval := range request.Approvals() {
+			status.Shares = append(status.Shares, types.RecoveredShare{
+				GuardianUsername: approval.Guardian().Username,
+				ShareIndex:       approval.ShareIndex,
+				Ciphertext:       approval.Ciphertext,
+			})
+		}
+	}
+	return status, nil
+}
+
+// CompleteRecovery resets the account key to the one named in the request once threshold
+// guardians approved it. The recovery configuration is removed since its shares protect the
+// old secret, the client is expected to set up recovery again.
+func (rs *RecoveryService) CompleteRecovery(ctx context.Context, requestID, token string) (*db.UserModel, types.PublicKey, error) {
+	request, err := rs.requestByToken(ctx, requestID, token)
+	if err != nil {
+		return nil, types.PublicKey{}, err
+	}
+	if request.Status != types.RecoveryStatusPending || time.Now().After(request.ExpiresAt) {
+		return nil, types.PublicKey{}, ErrRecoveryRequestNotFound
+	}
+	user := request.User()
+	config, ok := user.RecoveryConfig()
+	if !ok {
+		return nil, types.PublicKey{}, ErrRecoveryNotConfigured
+	}
+	if len(request.Approvals()) < config.Threshold {
+		return nil, types.PublicKey{}, ErrRecoveryThresholdNotMet
+	}
+
+	// the key reset, the request and the configuration change in one transaction, which fails
+	// as a whole unless this request is still pending when it runs. Other open requests are
+	// cancelled, they were for the configuration removed here, so two requests completed at the
+	// same time can not both reset the key.
+	newKey := types.PublicKey{X: request.NewPublicKeyX, Y: request.NewPublicKeyY, Ecdh: request.NewPublicKeyEcdh}
+	_, err = rs.authService.ResetIdentityKey(ctx, user, newKey, request.ID,
+		rs.completeIfPending(request.ID),
+		rs.cancelPending(user.ID),
+		rs.prismaClient.RecoveryConfig.FindMany(
+			db.RecoveryConfig.UserID.Equals(user.ID),
+		).Delete().Tx(),
+	)
+	if err != nil {
+		// a request completed or cancelled concurrently is reported as gone, whatever the error
+		if _, findErr := rs.pendingRequest(ctx, request.ID); errors.Is(findErr, ErrRecoveryRequestNotFound) {
+			return nil, types.PublicKey{}, ErrRecoveryRequestNotFound
+		}
+		return nil, types.PublicKey{}, err
+	}
+	rs.audit.Record(ctx, types.AuditRecoveryCompleted, user.ID, user.Username, map[string]interface{}{
+		"request_id": request.ID,
+	})
+	return user, newKey, nil
+}
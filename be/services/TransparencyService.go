@@ -0,0 +1,336 @@
+package services
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/prisma/db"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/types"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/utils"
+)
+
+// TransparencyService maintains an append-only Merkle log of every key a user registers or
+// rotates to, so clients can check that the key they were served is the one everybody sees.
+type TransparencyService struct {
+	prismaClient *db.PrismaClient
+	signingKey   *ecdsa.PrivateKey
+
+	mu   sync.Mutex
+	tree utils.MerkleTree    // leaf hashes by leaf index, lazily synced from the database
+	head types.SignedTreeHead // latest signed head, re-signed only when the tree grows
+}
+
+func NewTransparencyService(client *db.PrismaClient, signingKey *ecdsa.PrivateKey) *TransparencyService {
+	return &TransparencyService{
+		prismaClient: client,
+		signingKey:   signingKey,
+	}
+}
+
+// LoadLogSigningKey reads the PEM encoded P-256 key used to sign tree heads. The key has to
+// stay the same across restarts and replicas, otherwise earlier tree heads can not be verified.
+func LoadLogSigningKey(path string) (*ecdsa.PrivateKey, error) {
+	if path == "" {
+		return nil, fmt.Errorf("TRANSPARENCY_KEY_FILE is not set")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %s", path)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if key, ok = parsed.(*ecdsa.PrivateKey); !ok {
+			return nil, fmt.Errorf("transparency key must be a P-256 ECDSA key")
+		}
+	}
+	if key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("transparency key must be a P-256 ECDSA key")
+	}
+	return key, nil
+}
+
+// KeyLogLeaf is the exact byte string hashed into the log for one entry.
+func KeyLogLeaf(username string, pk types.PublicKey, loggedAt int64) []byte {
+	return []byte(strings.Join([]string{"kt-leaf", "v1", username, pk.X, pk.Y, pk.Ecdh, strconv.FormatInt(loggedAt, 10)}, "|"))
+}
+
+// TreeHeadStatement is the exact byte string whose SHA-256 digest is signed in a tree head.
+func TreeHeadStatement(size int, rootHex string, timestamp int64) []byte {
+	return []byte(strings.Join([]string{"kt-sth", "v1", strconv.Itoa(size), rootHex, strconv.FormatInt(timestamp, 10)}, "|"))
+}
+
+func entryFromModel(e *db.KeyLogEntryModel) types.KeyLogEntry {
+	return types.KeyLogEntry{
+		LeafIndex: e.LeafIndex,
+		Username:  e.Username,
+		PublicKey: types.PublicKey{
+			X:    e.PublicKeyX,
+			Y:    e.PublicKeyY,
+			Ecdh: e.PublicKeyEcdh,
+		},
+		LoggedAt: e.LoggedAt.Unix(),
+		LeafHash: e.LeafHash,
+	}
+}
+
+// syncLeaves loads entries appended since the last call, including those written by other replicas.
+// The caller must hold ts.mu.
+func (ts *TransparencyService) syncLeaves(ctx context.Context) error {
+	entries, err := ts.prismaClient.KeyLogEntry.FindMany(
+		db.KeyLogEntry.LeafIndex.Gte(ts.tree.Size()),
+	).OrderBy(
+		db.KeyLogEntry.LeafIndex.Order(db.SortOrderAsc),
+	).Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if e.LeafIndex != ts.tree.Size() {
+			return fmt.Errorf("key log has a gap at leaf %d", ts.tree.Size())
+		}
+		entry := entryFromModel(&e)
+		leaf := utils.MerkleLeafHash(KeyLogLeaf(entry.Username, entry.PublicKey, entry.LoggedAt))
+		if hex.EncodeToString(leaf) != e.LeafHash {
+			return fmt.Errorf("key log leaf %d does not match its contents", e.LeafIndex)
+		}
+		ts.tree.Append(leaf)
+	}
+	return nil
+}
+
+// Append adds a (username, signing key, ECDH key) binding to the log.
+func (ts *TransparencyService) Append(ctx context.Context, username string, pk types.PublicKey) (*db.KeyLogEntryModel, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	return ts.append(ctx, username, pk)
+}
+
+// append does the work of Append. The caller must hold ts.mu.
+func (ts *TransparencyService) append(ctx context.Context, username string, pk types.PublicKey) (*db.KeyLogEntryModel, error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		if err := ts.syncLeaves(ctx); err != nil {
+			return nil, err
+		}
+
+		loggedAt := time.Unix(time.Now().Unix(), 0)
+		leaf := utils.MerkleLeafHash(KeyLogLeaf(username, pk, loggedAt.Unix()))
+		entry, err := ts.prismaClient.KeyLogEntry.CreateOne(
+			db.KeyLogEntry.LeafIndex.Set(ts.tree.Size()),
+			db.KeyLogEntry.Username.Set(username),
+			db.KeyLogEntry.PublicKeyX.Set(pk.X),
+			db.KeyLogEntry.PublicKeyY.Set(pk.Y),
+			db.KeyLogEntry.PublicKeyEcdh.Set(pk.Ecdh),
+			db.KeyLogEntry.LeafHash.Set(hex.EncodeToString(leaf)),
+			db.KeyLogEntry.LoggedAt.Set(loggedAt),
+		).Exec(ctx)
+		if _, ok := db.IsErrUniqueConstraint(err); ok {
+			// another replica appended at the same index, catch up and try again
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		ts.tree.Append(leaf)
+		return entry, nil
+	}
+	return nil, fmt.Errorf("failed to append to key log after concurrent writes")
+}
+
+func (ts *TransparencyService) signTreeHead(size int, root []byte) (types.SignedTreeHead, error) {
+	now := time.Now().Unix()
+	rootHex := hex.EncodeToString(root)
+	digest := sha256.Sum256(TreeHeadStatement(size, rootHex, now))
+
+	r, s, err := ecdsa.Sign(rand.Reader, ts.signingKey, digest[:])
+	if err != nil {
+		return types.SignedTreeHead{}, err
+	}
+
+	return types.SignedTreeHead{
+		TreeSize:  size,
+		RootHash:  rootHex,
+		Timestamp: now,
+		Signature: types.Signature{
+			R: fmt.Sprintf("%064x", r),
+			S: fmt.Sprintf("%064x", s),
+		},
+		LogPublicKey: types.PublicKey{
+			X: fmt.Sprintf("%064x", ts.signingKey.X),
+			Y: fmt.Sprintf("%064x", ts.signingKey.Y),
+		},
+	}, nil
+}
+
+// latestHead returns a signed head over the whole log, signing a new one only when entries
+// were appended since the last. The caller must hold ts.mu and have synced the leaves.
+func (ts *TransparencyService) latestHead() (types.SignedTreeHead, error) {
+	size := ts.tree.Size()
+	if ts.head.Signature.R != "" && ts.head.TreeSize == size {
+		return ts.head, nil
+	}
+	head, err := ts.signTreeHead(size, ts.tree.Root(size))
+	if err != nil {
+		return types.SignedTreeHead{}, err
+	}
+	ts.head = head
+	return head, nil
+}
+
+// TreeHead returns a signed head over the whole log.
+func (ts *TransparencyService) TreeHead(ctx context.Context) (types.SignedTreeHead, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if err := ts.syncLeaves(ctx); err != nil {
+		return types.SignedTreeHead{}, err
+	}
+	return ts.latestHead()
+}
+
+func sameKey(e *db.KeyLogEntryModel, pk types.PublicKey) bool {
+	return e.PublicKeyX == pk.X && e.PublicKeyY == pk.Y && e.PublicKeyEcdh == pk.Ecdh
+}
+
+// BackfillKeyLog appends the current key of every user whose key is not their latest log
+// entry, e.g. accounts created before the log existed.
+func (ts *TransparencyService) BackfillKeyLog(ctx context.Context) error {
+	entries, err := ts.prismaClient.KeyLogEntry.FindMany().OrderBy(
+		db.KeyLogEntry.LeafIndex.Order(db.SortOrderAsc),
+	).Exec(ctx)
+	if err != nil {
+		return err
+	}
+	latest := make(map[string]*db.KeyLogEntryModel, len(entries))
+	for i := range entries {
+		latest[entries[i].Username] = &entries[i]
+	}
+
+	users, err := ts.prismaClient.User.FindMany().Exec(ctx)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		pk := types.PublicKey{X: user.PublicKeyX, Y: user.PublicKeyY, Ecdh: user.PublicKeyEcdh}
+		if e, ok := latest[user.Username]; ok && sameKey(e, pk) {
+			continue
+		}
+		if _, err := ts.Append(ctx, user.Username, pk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ts *TransparencyService) latestEntry(ctx context.Context, username string) (*db.KeyLogEntryModel, error) {
+	return ts.prismaClient.KeyLogEntry.FindFirst(
+		db.KeyLogEntry.Username.Equals(username),
+	).OrderBy(
+		db.KeyLogEntry.LeafIndex.Order(db.SortOrderDesc),
+	).Exec(ctx)
+}
+
+// InclusionProof proves that the user's current key is the latest entry of the log for
+// them. Keys are appended where they change, but that append is not part of the key change
+// itself, so a key missing from the log or differing from its latest entry is appended here.
+func (ts *TransparencyService) InclusionProof(ctx context.Context, username string, current types.PublicKey) (*types.InclusionProof, error) {
+	latest, err := ts.latestEntry(ctx, username)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return nil, err
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if latest == nil || !sameKey(latest, current) {
+		// look again under the lock, a concurrent lookup may have appended it already
+		latest, err = ts.latestEntry(ctx, username)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			return nil, err
+		}
+		if latest == nil || !sameKey(latest, current) {
+			if latest, err = ts.append(ctx, username, current); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := ts.syncLeaves(ctx); err != nil {
+		return nil, err
+	}
+	head, err := ts.latestHead()
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.InclusionProof{
+		Entry:     entryFromModel(latest),
+		AuditPath: hexList(ts.tree.InclusionProof(latest.LeafIndex, head.TreeSize)),
+		TreeHead:  head,
+	}, nil
+}
+
+// ConsistencyProof proves that the log at size first is a prefix of the log at size second.
+func (ts *TransparencyService) ConsistencyProof(ctx context.Context, first, second int) (*types.ConsistencyProof, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if err := ts.syncLeaves(ctx); err != nil {
+		return nil, err
+	}
+	size := ts.tree.Size()
+	if first < 1 || first > second || second > size {
+		return nil, fmt.Errorf("tree sizes must satisfy 1 <= first <= second <= %d", size)
+	}
+
+	var head types.SignedTreeHead
+	var err error
+	if second == size {
+		head, err = ts.latestHead()
+	} else {
+		head, err = ts.signTreeHead(second, ts.tree.Root(second))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.ConsistencyProof{
+		First:    first,
+		Second:   second,
+		Proof:    hexList(ts.tree.ConsistencyProof(first, second)),
+		TreeHead: head,
+	}, nil
+}
+
+func hexList(hashes [][]byte) []string {
+	out := make([]string, 0, len(hashes))
+	for _, h := range hashes {
+		out = append(out, hex.EncodeToString(h))
+	}
+	return out
+}
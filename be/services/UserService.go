@@ -1,38 +1,196 @@
 package services
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/prisma/db"
 	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/types"
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/utils"
+)
+
+var (
+	ErrUsernameTaken      = errors.New("username already registered")
+	ErrUsernameConfusable = errors.New("username looks too similar to an existing user")
+	ErrUsernameReserved   = errors.New("username belonged to a recently deleted account")
 )
 
 type UserService struct {
 	prismaClient *db.PrismaClient
+	audit        *AuditService
 }
 
-func NewUserService(client *db.PrismaClient) *UserService {
+func NewUserService(client *db.PrismaClient, audit *AuditService) *UserService {
 	return &UserService{
 		prismaClient: client,
+		audit:        audit,
 	}
 }
 
+// CreateUser stores a new user. username must already be validated with utils.ValidateUsername.
 func (us *UserService) CreateUser(ctx *gin.Context, username string, publicKeyHex types.PublicKey) (*db.UserModel, error) {
-	user, err := us.prismaClient.User.CreateOne(
+	// the user and its first key are written together, an account never exists without key history
+	userID := uuid.NewString()
+	created := us.prismaClient.User.CreateOne(
 		db.User.Username.Set(username),
 		db.User.PublicKeyX.Set(publicKeyHex.X),
 		db.User.PublicKeyY.Set(publicKeyHex.Y),
 		db.User.PublicKeyEcdh.Set(publicKeyHex.Ecdh),
-	).Exec(ctx)
-	if err != nil {
+		db.User.ID.Set(userID),
+		db.User.UsernameSkeleton.Set(utils.UsernameSkeleton(username)),
+	).Tx()
+	firstKey := us.prismaClient.UserKey.CreateOne(
+		db.UserKey.PublicKeyX.Set(publicKeyHex.X),
+		db.UserKey.PublicKeyY.Set(publicKeyHex.Y),
+		db.UserKey.PublicKeyEcdh.Set(publicKeyHex.Ecdh),
+		db.UserKey.User.Link(db.User.ID.Equals(userID)),
+	).Tx()
+	if err := us.prismaClient.Prisma.Transaction(created, firstKey).Exec(ctx); err != nil {
 		return nil, err
 	}
+	user := created.Result()
+	us.audit.Record(ctx, types.AuditUserRegistered, user.ID, user.Username, nil)
 
 	return user, nil
 }
 
+// CheckUsernameAvailable reports whether username is free and does not look like an existing username.
+func (us *UserService) CheckUsernameAvailable(ctx *gin.Context, username string) error {
+	if err := us.CheckUserExists(ctx, username); err == nil {
+		return ErrUsernameTaken
+	}
+	_, err := us.prismaClient.User.FindUnique(
+		db.User.UsernameSkeleton.Equals(utils.UsernameSkeleton(username)),
+	).Exec(ctx)
+	if err == nil {
+		return ErrUsernameConfusable
+	}
+	if !errors.Is(err, db.ErrNotFound) {
+		return err
+	}
+
+	_, err = us.prismaClient.DeletedUsername.FindFirst(
+		db.DeletedUsername.Or(
+			db.DeletedUsername.Username.Equals(username),
+			db.DeletedUsername.Skeleton.Equals(utils.UsernameSkeleton(username)),
+		),
+		db.DeletedUsername.ReservedUntil.After(time.Now()),
+	).Exec(ctx)
+	if err == nil {
+		return ErrUsernameReserved
+	}
+	if !errors.Is(err, db.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// usernameRename moves a user created before usernames were canonicalized to its canonical name.
+type usernameRename struct {
+	userID string
+	from   string
+	to     string
+}
+
+// planUsernameMigration returns the renames that bring users to their canonical username.
+// A canonical name claimed by more than one user is not given to any of them, those users
+// are returned as conflicts and keep their name until renamed by hand.
+func planUsernameMigration(users []db.UserModel) (renames []usernameRename, conflicts []string) {
+	claims := map[string]int{}
+	for _, user := range users {
+		claims[utils.CanonicalUsername(user.Username)]++
+	}
+	for _, user := range users {
+		canonical := utils.CanonicalUsername(user.Username)
+		if canonical == user.Username {
+			continue
+		}
+		if claims[canonical] > 1 {
+			conflicts = append(conflicts, user.Username)
+			continue
+		}
+		renames = append(renames, usernameRename{userID: user.ID, from: user.Username, to: canonical})
+	}
+	return renames, conflicts
+}
+
+// UsernameMigrationReport lists what MigrateUsernames changed and what it could not.
+type UsernameMigrationReport struct {
+	Renamed   map[string]string // old username to canonical username
+	Conflicts []string          // usernames whose canonical form is claimed by another user
+}
+
+// MigrateUsernames renames users created before usernames were canonicalized. The old name
+// is kept as keyUsername since the client derives the identity key from it, and the user's
+// sessions are revoked because their tokens carry the old name. The skeleton is cleared so
+// BackfillUsernameSkeletons recomputes it. Conflicting users are left as they are and
+// reported, they have to be renamed by hand.
+func (us *UserService) MigrateUsernames(ctx context.Context) (UsernameMigrationReport, error) {
+	users, err := us.prismaClient.User.FindMany().Exec(ctx)
+	if err != nil {
+		return UsernameMigrationReport{}, err
+	}
+
+	renames, conflicts := planUsernameMigration(users)
+	report := UsernameMigrationReport{Renamed: make(map[string]string, len(renames)), Conflicts: conflicts}
+	for _, rename := range renames {
+		err := us.prismaClient.Prisma.Transaction(
+			us.prismaClient.User.FindUnique(
+				db.User.ID.Equals(rename.userID),
+			).Update(
+				db.User.Username.Set(rename.to),
+				db.User.KeyUsername.Set(rename.from),
+				db.User.UsernameSkeleton.SetOptional(nil),
+			).Tx(),
+			us.prismaClient.UserSession.FindMany(
+				db.UserSession.UserID.Equals(rename.userID),
+				db.UserSession.IsRevoked.Equals(false),
+			).Update(
+				db.UserSession.IsRevoked.Set(true),
+				db.UserSession.RevokedAt.Set(time.Now()),
+			).Tx(),
+		).Exec(ctx)
+		if err != nil {
+			return report, fmt.Errorf("failed to rename %q: %w", rename.from, err)
+		}
+		report.Renamed[rename.from] = rename.to
+	}
+	return report, nil
+}
+
+// BackfillUsernameSkeletons fills in the skeleton of users created before it was stored.
+// Users whose skeleton collides with another user are logged and left without one.
+func (us *UserService) BackfillUsernameSkeletons(ctx context.Context) error {
+	users, err := us.prismaClient.User.FindMany(
+		db.User.UsernameSkeleton.IsNull(),
+	).Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		_, err := us.prismaClient.User.FindUnique(
+			db.User.ID.Equals(user.ID),
+		).Update(
+			db.User.UsernameSkeleton.Set(utils.UsernameSkeleton(user.Username)),
+		).Exec(ctx)
+		if _, ok := db.IsErrUniqueConstraint(err); ok {
+			log.Printf("Username %q looks like another user, skeleton not stored", user.Username)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (us *UserService) CheckUserExists(ctx *gin.Context, username string) error {
 	_, err := us.prismaClient.User.FindUnique(
 		db.User.Username.Equals(username),
@@ -54,7 +212,64 @@ func (us *UserService) GetPublicKey(ctx *gin.Context, username string) (types.Pu
 	}, nil
 }
 
-func (us *UserService) GetUserByUsername(ctx *gin.Context, username string) (*db.UserModel, error) {
+// GetKeyHistory returns every identity key the user has had, oldest first.
+func (us *UserService) GetKeyHistory(ctx *gin.Context, username string) ([]types.UserKey, error) {
+	keys, err := us.prismaClient.UserKey.FindMany(
+		db.UserKey.User.Where(db.User.Username.Equals(username)),
+	).OrderBy(
+		db.UserKey.ValidFrom.Order(db.SortOrderAsc),
+	).Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]types.UserKey, 0, len(keys))
+	for _, k := range keys {
+		history = append(history, UserKeyFromModel(&k))
+	}
+	return history, nil
+}
+
+func UserKeyFromModel(k *db.UserKeyModel) types.UserKey {
+	key := types.UserKey{
+		ID: k.ID,
+		PublicKey: types.PublicKey{
+			X:    k.PublicKeyX,
+			Y:    k.PublicKeyY,
+			Ecdh: k.PublicKeyEcdh,
+		},
+		ValidFrom: k.ValidFrom.Format(time.RFC3339),
+	}
+	if until, ok := k.ValidUntil(); ok {
+		key.ValidUntil = until.Format(time.RFC3339)
+	}
+	r, okR := k.RotationSignatureR()
+	s, okS := k.RotationSignatureS()
+	if okR && okS {
+		key.RotationSignature = &types.Signature{R: r, S: s}
+	}
+	return key
+}
+
+// GetLoginUser looks up the account a login names. The exact name is tried first so users
+// MigrateUsernames could not rename can still log in, then the canonical one.
+func (us *UserService) GetLoginUser(ctx context.Context, username string) (*db.UserModel, error) {
+	user, err := us.GetUserByUsername(ctx, strings.TrimSpace(username))
+	if errors.Is(err, db.ErrNotFound) {
+		return us.GetUserByUsername(ctx, utils.CanonicalUsername(username))
+	}
+	return user, err
+}
+
+// KeyUsername returns the username the client derives user's identity key from.
+func KeyUsername(user *db.UserModel) string {
+	if keyUsername, ok := user.KeyUsername(); ok && keyUsername != "" {
+		return keyUsername
+	}
+	return user.Username
+}
+
+func (us *UserService) GetUserByUsername(ctx context.Context, username string) (*db.UserModel, error) {
 	user, err := us.prismaClient.User.FindUnique(
 		db.User.Username.Equals(username),
 	).Exec(ctx)
@@ -89,7 +304,7 @@ func (us *UserService) GetAllMessagesByUser(ctx *gin.Context, username string) (
 	return messagePointers, nil
 }
 
-func (us *UserService) GetFriends(ctx *gin.Context, username string) ([]db.UserModel, error) {
+func (us *UserService) GetFriends(ctx context.Context, username string) ([]db.UserModel, error) {
 	user, err := us.GetUserByUsername(ctx, username)
 	if err != nil {
 		return nil, err
@@ -120,6 +335,26 @@ func (us *UserService) GetFriends(ctx *gin.Context, username string) ([]db.UserM
 	return friends, nil
 }
 
+// GetPrivacySettings returns the privacy settings of userID.
+func (us *UserService) GetPrivacySettings(ctx context.Context, userID string) (types.PrivacySettings, error) {
+	user, err := us.prismaClient.User.FindUnique(
+		db.User.ID.Equals(userID),
+	).Exec(ctx)
+	if err != nil {
+		return types.PrivacySettings{}, err
+	}
+	return types.PrivacySettings{HideLastSeen: user.HideLastSeen}, nil
+}
+
+func (us *UserService) UpdatePrivacySettings(ctx context.Context, userID string, settings types.PrivacySettings) error {
+	_, err := us.prismaClient.User.FindUnique(
+		db.User.ID.Equals(userID),
+	).Update(
+		db.User.HideLastSeen.Set(settings.HideLastSeen),
+	).Exec(ctx)
+	return err
+}
+
 func (us *UserService) AddFriend(ctx *gin.Context, username, friendUsername string) (*db.UserFriendModel, error) {
 	user, err := us.GetUserByUsername(ctx, username)
 	if err != nil {
@@ -152,6 +387,9 @@ func (us *UserService) AddFriend(ctx *gin.Context, username, friendUsername stri
 		}
 		return nil, err
 	}
+	us.audit.Record(ctx, types.AuditFriendAdded, user.ID, user.Username, map[string]interface{}{
+		"friend": friend.Username,
+	})
 
 	return friendship, nil
 }
@@ -182,6 +420,9 @@ func (us *UserService) DeleteFriend(ctx *gin.Context, username, friendUsername s
 	if err != nil {
 		return fmt.Errorf("failed to delete friendship: %w", err)
 	}
+	us.audit.Record(ctx, types.AuditFriendRemoved, user.ID, user.Username, map[string]interface{}{
+		"friend": friend.Username,
+	})
 	
 	return nil
 }
\ No newline at end of file
@@ -0,0 +1,81 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rifchzschki/Encryption-E2E-Simulation-in-Chat-App/prisma/db"
+)
+
+func userModel(id, username string) db.UserModel {
+	return db.UserModel{InnerUser: db.InnerUser{ID: id, Username: username}}
+}
+
+func TestPlanUsernameMigration(t *testing.T) {
+	tests := []struct {
+		name          string
+		users         []db.UserModel
+		wantRenames   []usernameRename
+		wantConflicts []string
+	}{
+		{
+			name:  "canonical usernames stay",
+			users: []db.UserModel{userModel("1", "alice"), userModel("2", "bob")},
+		},
+		{
+			name:        "pre-existing mixed case account is renamed",
+			users:       []db.UserModel{userModel("1", "Alice"), userModel("2", "bob")},
+			wantRenames: []usernameRename{{userID: "1", from: "Alice", to: "alice"}},
+		},
+		{
+			name:        "compatibility characters are folded",
+			users:       []db.UserModel{userModel("1", "ｃａｒｏｌ")},
+			wantRenames: []usernameRename{{userID: "1", from: "ｃａｒｏｌ", to: "carol"}},
+		},
+		{
+			name:          "canonical name taken by another user",
+			users:         []db.UserModel{userModel("1", "Bob"), userModel("2", "bob")},
+			wantConflicts: []string{"Bob"},
+		},
+		{
+			name:          "two legacy names with the same canonical form",
+			users:         []db.UserModel{userModel("1", "Dave"), userModel("2", "DAVE")},
+			wantConflicts: []string{"Dave", "DAVE"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			renames, conflicts := planUsernameMigration(tt.users)
+			if !reflect.DeepEqual(renames, tt.wantRenames) {
+				t.Errorf("renames = %+v, want %+v", renames, tt.wantRenames)
+			}
+			if !reflect.DeepEqual(conflicts, tt.wantConflicts) {
+				t.Errorf("conflicts = %v, want %v", conflicts, tt.wantConflicts)
+			}
+		})
+	}
+}
+
+func TestKeyUsername(t *testing.T) {
+	legacy := "Alice"
+	migrated := userModel("1", "alice")
+	migrated.InnerUser.KeyUsername = &legacy
+
+	tests := []struct {
+		name string
+		user db.UserModel
+		want string
+	}{
+		{"pre-existing mixed case account keeps its original name", migrated, "Alice"},
+		{"new account derives from its username", userModel("2", "bob"), "bob"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := KeyUsername(&tt.user); got != tt.want {
+				t.Errorf("KeyUsername() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
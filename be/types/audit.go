@@ -0,0 +1,55 @@
+package types
+
+const (
+	AuditLoginSucceeded     = "login_succeeded"
+	AuditLoginFailed        = "login_failed"
+	AuditLoginLocked        = "login_locked"
+	AuditRefreshTokenReuse  = "refresh_token_reuse"
+	AuditSessionRevoked     = "session_revoked"
+	AuditUserRegistered     = "user_registered"
+	AuditKeyRotated         = "key_rotated"
+	AuditFriendAdded        = "friend_added"
+	AuditFriendRemoved      = "friend_removed"
+	AuditDeviceRegistered   = "device_registered"
+	AuditDeviceRevoked      = "device_revoked"
+	AuditAccountDeleted     = "account_deleted"
+	AuditRecoveryConfigured = "recovery_configured"
+	AuditRecoveryRequested  = "recovery_requested"
+	AuditRecoveryApproved   = "recovery_approved"
+	AuditRecoveryCompleted  = "recovery_completed"
+)
+
+const MAX_AUDIT_PAGE_SIZE = 200
+
+type AuditEvent struct {
+	Seq       int                    `json:"seq"`
+	Type      string                 `json:"type"`
+	UserID    string                 `json:"user_id,omitempty"`
+	Username  string                 `json:"username,omitempty"`
+	IPAddress string                 `json:"ip_address,omitempty"`
+	UserAgent string                 `json:"user_agent,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	CreatedAt string                 `json:"created_at"`
+	PrevHash  string                 `json:"prev_hash"`
+	Hash      string                 `json:"hash"`
+}
+
+// AuditQuery filters audit events. Pages go backwards in time: pass the smallest seq
+// of the previous page as Before to get the next one.
+type AuditQuery struct {
+	Type      string `form:"type"`
+	UserID    string `form:"user_id"`
+	Username  string `form:"username"`
+	IPAddress string `form:"ip"`
+	From      string `form:"from"`
+	To        string `form:"to"`
+	Before    int    `form:"before"`
+	Limit     int    `form:"limit"`
+}
+
+type AuditChainStatus struct {
+	Valid    bool   `json:"valid"`
+	Checked  int    `json:"checked"`
+	BrokenAt *int   `json:"broken_at,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
@@ -7,6 +7,13 @@ type IdentityPayload struct{
 	PublicKeyHex PublicKey `json:"publicKeyHex"`
 }
 
+type RegisterRequest struct{
+	Username string `json:"username"`
+	PublicKeyHex PublicKey `json:"publicKeyHex"`
+	Nonce string `json:"nonce"`
+	Signature Signature `json:"signature"`
+}
+
 type PublicKey struct{
 	X string `json:"x"`
 	Y string `json:"y"`
@@ -15,6 +22,7 @@ type PublicKey struct{
 
 type LoginRequest struct {
 	Username string `json:"username"`
+	Nonce string `json:"nonce"`
 	Signature Signature `json:"signature"`
 }
 
@@ -29,6 +37,20 @@ type NonceChallengeRequest struct{
 
 type ChallengeResponse struct{
 	Nonce string `json:"nonce"`
+	// username tersimpan dan username untuk menurunkan kunci, hanya untuk login
+	Username    string `json:"username,omitempty"`
+	KeyUsername string `json:"key_username,omitempty"`
+}
+
+type KeyRotationRequest struct {
+	PublicKeyHex PublicKey `json:"publicKeyHex"`
+	Timestamp string `json:"timestamp"`
+	Signature Signature `json:"signature"`
+}
+
+type AccountDeletionRequest struct {
+	Timestamp string `json:"timestamp"`
+	Signature Signature `json:"signature"`
 }
 
 type PublicKeyResponse struct {
@@ -37,4 +59,37 @@ type PublicKeyResponse struct {
 }
 
 const EXPIRATION_REFRESH_TOKEN time.Duration = 1 * time.Hour // 1 Jam
-const EXPIRATION_ACCESS_TOKEN time.Duration = 5 * time.Minute // 5 menit
\ No newline at end of file
+const EXPIRATION_ACCESS_TOKEN time.Duration = 5 * time.Minute // 5 menit
+const EXPIRATION_NONCE time.Duration = 2 * time.Minute // 2 menit
+const EXPIRATION_WS_TICKET time.Duration = 30 * time.Second // 30 detik, sekali pakai
+const KEY_ROTATION_MAX_SKEW time.Duration = 5 * time.Minute // 5 menit
+const ACCOUNT_DELETION_MAX_SKEW time.Duration = 5 * time.Minute // 5 menit
+const USERNAME_RESERVATION time.Duration = 30 * 24 * time.Hour // 30 hari
+const REFRESH_TOKEN_REUSE_GRACE time.Duration = 5 * time.Second // 5 detik
+const LOGIN_LOCKOUT_THRESHOLD = 5 // gagal berturut-turut sebelum dikunci
+const LOGIN_LOCKOUT_BASE time.Duration = 30 * time.Second // 30 detik, berlipat dua tiap gagal
+const LOGIN_LOCKOUT_MAX time.Duration = 15 * time.Minute // 15 menit
+const LOGIN_FAILURE_WINDOW time.Duration = 15 * time.Minute // 15 menit
+
+// WS_SUBPROTOCOL must be offered by clients that pass their access token as a
+// "access_token.<jwt>" subprotocol, the server only ever echoes this one.
+const WS_SUBPROTOCOL = "e2e-chat"
+const WS_TOKEN_PROTOCOL_PREFIX = "access_token."
+
+type WSTicketResponse struct {
+	Ticket    string `json:"ticket"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+const WS_REAUTH_WARNING time.Duration = 1 * time.Minute // 1 menit sebelum token kedaluwarsa
+
+const WS_MESSAGES_PER_SECOND = 10
+const WS_MESSAGE_BURST = 20
+const WS_MAX_RATE_VIOLATIONS = 50 // frame ditolak sebelum koneksi ditutup
+
+const WS_WRITE_WAIT time.Duration = 10 * time.Second // 10 detik per frame
+const WS_PONG_WAIT time.Duration = 60 * time.Second // 60 detik tanpa pong, koneksi dianggap putus
+const WS_PING_PERIOD time.Duration = WS_PONG_WAIT * 9 / 10 // 54 detik
+const WS_MAX_FRAME_SIZE = 256 * 1024 // 256 KiB, cukup untuk salinan ciphertext tiap device
+const WS_SEND_QUEUE = 256 // frame yang antre sebelum client dianggap terlalu lambat
+const WS_REPLAY_PAGE_SIZE = 200 // pesan per query saat replay
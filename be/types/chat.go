@@ -11,6 +11,32 @@ type IncomingPayload struct {
         S string `json:"s"`
     } `json:"signature"`
     Timestamp string `json:"timestamp"`
+    VerifiedAt string `json:"verified_at,omitempty"`
+    SenderKeyID string `json:"sender_key_id,omitempty"`
+    SenderDeviceID string `json:"sender_device_id,omitempty"`
+    // Ciphertexts holds one copy per device when the sender encrypts for each device separately.
+    // On delivery it is cleared and DeviceID names the device encrypted_message is addressed to.
+    Ciphertexts []DeviceCiphertext `json:"ciphertexts,omitempty"`
+    DeviceID string `json:"device_id,omitempty"`
+    DeliveredAt string `json:"delivered_at,omitempty"`
+    ReadAt string `json:"read_at,omitempty"`
+}
+
+const (
+    ReceiptDelivered = "delivered"
+    ReceiptRead      = "read"
+)
+
+// Receipt is the delivery state of a message the user sent.
+type Receipt struct {
+    MessageID        string `json:"message_id"`
+    ReceiverUsername string `json:"receiver_username"`
+    DeliveredAt      string `json:"delivered_at,omitempty"`
+    ReadAt           string `json:"read_at,omitempty"`
+}
+
+type MarkReadRequest struct {
+    UpTo string `json:"up_to"`
 }
 
 type ChatMetadata struct {
@@ -0,0 +1,27 @@
+package types
+
+// MAX_DEVICES_PER_USER caps the active devices of one account, which also bounds the fan-out of a message.
+const MAX_DEVICES_PER_USER = 10
+
+type DeviceRegistrationRequest struct {
+	Name             string    `json:"name" binding:"max=64"`
+	PublicKeyHex     PublicKey `json:"publicKeyHex"`
+	Nonce            string    `json:"nonce"`
+	Signature        Signature `json:"signature"`
+	AccountSignature Signature `json:"account_signature"`
+}
+
+type Device struct {
+	ID               string    `json:"id"`
+	Name             string    `json:"name,omitempty"`
+	PublicKeyHex     PublicKey `json:"publicKeyHex"`
+	AccountSignature Signature `json:"account_signature"`
+	CreatedAt        string    `json:"created_at"`
+	LastSeenAt       string    `json:"last_seen_at,omitempty"`
+}
+
+// DeviceCiphertext is the copy of a message encrypted for a single recipient device.
+type DeviceCiphertext struct {
+	DeviceID         string `json:"device_id"`
+	EncryptedMessage string `json:"encrypted_message"`
+}
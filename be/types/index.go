@@ -1,6 +1,13 @@
 package types
 
-import "github.com/gin-gonic/gin"
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
 
 func SuccessResponse(ctx *gin.Context, message string, data interface{}) {
 	ctx.JSON(200, gin.H{
@@ -16,4 +23,14 @@ func FailResponse(ctx *gin.Context, status int, message string, err interface{})
 		"message": message,
 		"error":   err,
 	})
-}
\ No newline at end of file
+}
+
+// TooManyRequestsResponse rejects a rate limited request and tells the client when to retry.
+func TooManyRequestsResponse(ctx *gin.Context, message string, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	ctx.Header("Retry-After", strconv.Itoa(seconds))
+	FailResponse(ctx, http.StatusTooManyRequests, message, gin.H{"retry_after": seconds})
+}
@@ -0,0 +1,30 @@
+package types
+
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+// Presence is what friends see of a user. LastSeen is only set for offline users that do
+// not hide it.
+type Presence struct {
+	Username string `json:"username"`
+	Status   string `json:"status"`
+	LastSeen string `json:"last_seen,omitempty"`
+}
+
+type PrivacySettings struct {
+	HideLastSeen bool `json:"hide_last_seen"`
+}
+
+// PresenceUpdatePayload is sent by the client to switch between online and away.
+type PresenceUpdatePayload struct {
+	Status string `json:"status"`
+}
+
+// TypingPayload names the conversation partner: the receiver when sent by the client, the
+// typing user when relayed by the server.
+type TypingPayload struct {
+	Username string `json:"username"`
+}
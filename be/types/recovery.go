@@ -0,0 +1,83 @@
+package types
+
+import "time"
+
+const MIN_RECOVERY_THRESHOLD = 2
+const MAX_RECOVERY_GUARDIANS = 10
+const RECOVERY_REQUEST_TTL time.Duration = 48 * time.Hour // 2 hari
+const MAX_OPEN_RECOVERY_REQUESTS = 3 // request pending per akun, request baru tidak membatalkan yang lama
+
+const (
+	RecoveryStatusPending   = "pending"
+	RecoveryStatusCompleted = "completed"
+	RecoveryStatusCancelled = "cancelled"
+)
+
+type RecoveryShareInput struct {
+	GuardianUsername string `json:"guardian_username"`
+	ShareIndex       int    `json:"share_index"`
+	Ciphertext       string `json:"ciphertext"`
+}
+
+type RecoverySetupRequest struct {
+	Threshold       int                  `json:"threshold"`
+	EncryptedSecret string               `json:"encrypted_secret"`
+	Shares          []RecoveryShareInput `json:"shares"`
+}
+
+type RecoveryConfigInfo struct {
+	Threshold int      `json:"threshold"`
+	Guardians []string `json:"guardians"`
+	CreatedAt string   `json:"created_at"`
+}
+
+type RecoveryStartRequest struct {
+	Username     string    `json:"username"`
+	EphemeralKey string    `json:"ephemeral_key"`
+	PublicKeyHex PublicKey `json:"publicKeyHex"`
+	Signature    Signature `json:"signature"`
+}
+
+type RecoveryStartResponse struct {
+	RequestID string `json:"request_id"`
+	Token     string `json:"token"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+// GuardianRecoveryRequest is a pending recovery shown to a guardian, with the share
+// they hold so they can re-encrypt it to the ephemeral key of the request.
+type GuardianRecoveryRequest struct {
+	RequestID    string    `json:"request_id"`
+	Username     string    `json:"username"`
+	EphemeralKey string    `json:"ephemeral_key"`
+	PublicKeyHex PublicKey `json:"publicKeyHex"`
+	ShareIndex   int       `json:"share_index"`
+	Ciphertext   string    `json:"ciphertext"`
+	CreatedAt    string    `json:"created_at"`
+	ExpiresAt    string    `json:"expires_at"`
+}
+
+type RecoveryApproveRequest struct {
+	Ciphertext string    `json:"ciphertext"`
+	Signature  Signature `json:"signature"`
+}
+
+type RecoveryTokenRequest struct {
+	Token string `json:"token" form:"token"`
+}
+
+type RecoveredShare struct {
+	GuardianUsername string `json:"guardian_username"`
+	ShareIndex       int    `json:"share_index"`
+	Ciphertext       string `json:"ciphertext"`
+}
+
+type RecoveryStatus struct {
+	RequestID       string           `json:"request_id"`
+	Status          string           `json:"status"`
+	Threshold       int              `json:"threshold"`
+	Approvals       int              `json:"approvals"`
+	ExpiresAt       string           `json:"expires_at"`
+	EncryptedSecret string           `json:"encrypted_secret,omitempty"`
+	Shares          []RecoveredShare `json:"shares,omitempty"`
+}
@@ -0,0 +1,15 @@
+package types
+
+type SessionInfo struct {
+	ID        string `json:"id"`
+	Name      string `json:"name,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	IPAddress string `json:"ip_address,omitempty"`
+	CreatedAt string `json:"created_at"`
+	ExpiresAt string `json:"expires_at"`
+	Current   bool   `json:"current"`
+}
+
+type RenameSessionRequest struct {
+	Name string `json:"name" binding:"required,max=64"`
+}
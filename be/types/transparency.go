@@ -0,0 +1,30 @@
+package types
+
+type SignedTreeHead struct {
+	TreeSize     int       `json:"tree_size"`
+	RootHash     string    `json:"root_hash"`
+	Timestamp    int64     `json:"timestamp"`
+	Signature    Signature `json:"signature"`
+	LogPublicKey PublicKey `json:"log_public_key"`
+}
+
+type KeyLogEntry struct {
+	LeafIndex int       `json:"leaf_index"`
+	Username  string    `json:"username"`
+	PublicKey PublicKey `json:"public_key"`
+	LoggedAt  int64     `json:"logged_at"`
+	LeafHash  string    `json:"leaf_hash"`
+}
+
+type InclusionProof struct {
+	Entry     KeyLogEntry    `json:"entry"`
+	AuditPath []string       `json:"audit_path"`
+	TreeHead  SignedTreeHead `json:"tree_head"`
+}
+
+type ConsistencyProof struct {
+	First    int            `json:"first"`
+	Second   int            `json:"second"`
+	Proof    []string       `json:"proof"`
+	TreeHead SignedTreeHead `json:"tree_head"`
+}
@@ -4,4 +4,19 @@ type User struct {
 	ID        string    `json:"id"`
 	Username  string    `json:"username"`
 	PublicKey PublicKey `json:"public_key"`
-}
\ No newline at end of file
+}
+
+type UserKey struct {
+	ID                string     `json:"id"`
+	PublicKey         PublicKey  `json:"public_key"`
+	ValidFrom         string     `json:"valid_from"`
+	ValidUntil        string     `json:"valid_until,omitempty"`
+	RotationSignature *Signature `json:"rotation_signature,omitempty"`
+}
+
+type PublicKeyLookupResponse struct {
+	Username     string    `json:"username"`
+	PublicKeyHex PublicKey `json:"publicKeyHex"`
+	History      []UserKey `json:"history,omitempty"`
+	Transparency *InclusionProof `json:"transparency,omitempty"`
+}
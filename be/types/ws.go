@@ -0,0 +1,175 @@
+package types
+
+import "encoding/json"
+
+// Every frame on the chat socket, in both directions, is an Envelope. The client starts
+// with a hello frame listing the protocol versions it speaks and the server answers with
+// welcome, naming the version used for the rest of the connection. Client frames that carry
+// an id are answered with an ack or an error frame with the same id.
+type Envelope struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	V       int             `json:"v"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+const WS_PROTOCOL_VERSION = 1
+
+var WS_SUPPORTED_VERSIONS = []int{WS_PROTOCOL_VERSION}
+
+// Frames sent by the client. FrameMessage is also sent by the server to deliver a message.
+const (
+	FrameHello   = "hello"
+	FrameMessage = "message"
+	FrameReauth  = "reauth"
+)
+
+// Presence and typing frames, sent by the client for itself and relayed by the server to
+// friends. Typing frames are never stored.
+const (
+	FramePresence    = "presence"
+	FrameTypingStart = "typing_start"
+	FrameTypingStop  = "typing_stop"
+)
+
+// Receipt frames. The client sends them for messages it received, the server forwards
+// them to the sender of those messages.
+const (
+	FrameDelivered = "delivered"
+	FrameRead      = "read"
+)
+
+// Frames sent by the server. FrameAck is also sent by the client to acknowledge the messages
+// it received.
+const (
+	FrameWelcome           = "welcome"
+	FrameSynced            = "synced"
+	FrameAck               = "ack"
+	FrameError             = "error"
+	FrameReauthRequired    = "reauth_required"
+	FrameReauthOK          = "reauth_ok"
+	FrameFriendlistChanged = "friendlist_changed"
+	FrameContactDeleted    = "contact_deleted"
+	FrameRecovery          = "recovery"
+	FrameSecurityAlert     = "security_alert"
+)
+
+// Codes of error frames.
+const (
+	ErrCodeBadFrame           = "bad_frame"
+	ErrCodeHelloRequired      = "hello_required"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeUnknownType        = "unknown_type"
+	ErrCodeInvalidPayload     = "invalid_payload"
+	ErrCodeSenderMismatch     = "sender_mismatch"
+	ErrCodeUnknownReceiver    = "unknown_receiver"
+	ErrCodeNotFriends         = "not_friends"
+	ErrCodeInvalidSignature   = "invalid_signature"
+	ErrCodeUnknownDevice      = "unknown_device"
+	ErrCodeStaleDeviceList    = "stale_device_list"
+	ErrCodeRateLimited        = "rate_limited"
+	ErrCodeReauthFailed       = "reauth_failed"
+	ErrCodeInternal           = "internal_error"
+)
+
+type HelloPayload struct {
+	Versions []int `json:"versions"`
+	// ReceiptsSince, a unix timestamp, asks for the receipts recorded since then, e.g. the
+	// time the client was last connected.
+	ReceiptsSince int64 `json:"receipts_since,omitempty"`
+	// LastMessageID asks for every message newer than it, across all conversations, to be
+	// replayed before live messages are delivered. "0" replays everything.
+	LastMessageID string `json:"last_message_id,omitempty"`
+}
+
+type WelcomePayload struct {
+	Version   int    `json:"version"`
+	Username  string `json:"username"`
+	ExpiresAt int64  `json:"expires_at"`
+	// Cursor is the newest message any client of the user acknowledged.
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// SyncedPayload ends a replay. LastMessageID is the newest message replayed, or the one the
+// client asked to resume from if there was nothing to replay.
+type SyncedPayload struct {
+	LastMessageID string `json:"last_message_id"`
+	Replayed      int    `json:"replayed"`
+	Timestamp     int64  `json:"timestamp"`
+}
+
+type AckPayload struct {
+	MessageID string `json:"message_id,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type ErrorPayload struct {
+	Code              string `json:"code"`
+	Message           string `json:"message"`
+	RetryAfterMs      int64  `json:"retry_after_ms,omitempty"`
+	SupportedVersions []int  `json:"supported_versions,omitempty"`
+	Timestamp         int64  `json:"timestamp"`
+}
+
+// ReceiptPayload covers every message of a conversation up to and including UpTo. From the
+// client Username is the sender of those messages, from the server it is the reader.
+type ReceiptPayload struct {
+	Username string `json:"username"`
+	UpTo     string `json:"up_to,omitempty"`
+	At       int64  `json:"at,omitempty"`
+}
+
+type ReauthPayload struct {
+	Token string `json:"token"`
+}
+
+type ReauthStatusPayload struct {
+	ExpiresAt int64 `json:"expires_at"`
+	Timestamp int64 `json:"timestamp"`
+}
+
+type FriendlistChangedPayload struct {
+	Username     string      `json:"username"`
+	FriendshipID interface{} `json:"friendship_id"`
+	Timestamp    int64       `json:"timestamp"`
+}
+
+type ContactDeletedPayload struct {
+	Username  string `json:"username"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type RecoveryEventPayload struct {
+	Kind      string `json:"kind"`
+	RequestID string `json:"request_id"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type SecurityAlertPayload struct {
+	Reason    string `json:"reason"`
+	SessionID string `json:"session_id"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// Kinds of SocketEvent.
+const (
+	SocketEventFrame   = "frame"
+	SocketEventMessage = "message"
+	SocketEventClose   = "close"
+)
+
+// SocketEvent is published on the bus channel of a user. Every replica applies it to the
+// sockets of that user it holds: a frame is written to all of them, a message is routed to
+// each socket by device, and close disconnects them, or only those of DeviceID when set.
+// Closing revoked sessions goes to a channel of its own, with the sessions in SessionIDs.
+type SocketEvent struct {
+	Kind       string           `json:"kind"`
+	Frame      string           `json:"frame,omitempty"`
+	Payload    json.RawMessage  `json:"payload,omitempty"`
+	Message    *IncomingPayload `json:"message,omitempty"`
+	SkipConn   string           `json:"skip_conn,omitempty"` // connection the event originates from
+	DeviceID   string           `json:"device_id,omitempty"`
+	SessionIDs []string         `json:"session_ids,omitempty"`
+	CloseCode  int              `json:"close_code,omitempty"`
+	Reason     string           `json:"reason,omitempty"`
+}
@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"crypto/ecdh"
+	"crypto/elliptic"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+)
+
+// ValidateP256Point checks that the hex encoded affine coordinates form a valid,
+// non-identity point on P-256.
+func ValidateP256Point(xHex, yHex string) error {
+	x, ok := new(big.Int).SetString(xHex, 16)
+	if !ok {
+		return fmt.Errorf("public key X is not valid hex")
+	}
+	y, ok := new(big.Int).SetString(yHex, 16)
+	if !ok {
+		return fmt.Errorf("public key Y is not valid hex")
+	}
+	if x.Sign() < 0 || y.Sign() < 0 || x.BitLen() > 256 || y.BitLen() > 256 {
+		return fmt.Errorf("public key coordinates are out of range")
+	}
+
+	uncompressed := make([]byte, 65)
+	uncompressed[0] = 0x04
+	x.FillBytes(uncompressed[1:33])
+	y.FillBytes(uncompressed[33:])
+	if _, err := ecdh.P256().NewPublicKey(uncompressed); err != nil {
+		return fmt.Errorf("public key is not a point on P-256")
+	}
+	return nil
+}
+
+// ValidateCompressedP256 checks that the hex string is a SEC 1 compressed P-256 point.
+func ValidateCompressedP256(pointHex string) error {
+	raw, err := hex.DecodeString(pointHex)
+	if err != nil {
+		return fmt.Errorf("ECDH key is not valid hex")
+	}
+	if len(raw) != 33 || (raw[0] != 0x02 && raw[0] != 0x03) {
+		return fmt.Errorf("ECDH key must be a 33 byte compressed point")
+	}
+	if x, _ := elliptic.UnmarshalCompressed(elliptic.P256(), raw); x == nil {
+		return fmt.Errorf("ECDH key is not a point on P-256")
+	}
+	return nil
+}
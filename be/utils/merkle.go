@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"math/bits"
+)
+
+// Merkle tree helpers following RFC 6962 section 2.1, so proofs can be checked
+// with any certificate-transparency style verifier.
+
+func MerkleLeafHash(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x00})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func merkleNodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// largestPowerOfTwoBelow returns the largest power of two strictly smaller than n (n > 1).
+func largestPowerOfTwoBelow(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// MerkleRoot computes the tree head over already hashed leaves.
+func MerkleRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	case 1:
+		return leaves[0]
+	}
+	k := largestPowerOfTwoBelow(len(leaves))
+	return merkleNodeHash(MerkleRoot(leaves[:k]), MerkleRoot(leaves[k:]))
+}
+
+// MerkleInclusionProof returns the audit path for leaf index m in the tree built from leaves.
+func MerkleInclusionProof(m int, leaves [][]byte) [][]byte {
+	n := len(leaves)
+	if n <= 1 {
+		return [][]byte{}
+	}
+	k := largestPowerOfTwoBelow(n)
+	if m < k {
+		return append(MerkleInclusionProof(m, leaves[:k]), MerkleRoot(leaves[k:]))
+	}
+	return append(MerkleInclusionProof(m-k, leaves[k:]), MerkleRoot(leaves[:k]))
+}
+
+// MerkleConsistencyProof proves that the tree of the first m leaves is a prefix of the tree over all leaves.
+func MerkleConsistencyProof(m int, leaves [][]byte) [][]byte {
+	if m <= 0 || m >= len(leaves) {
+		return [][]byte{}
+	}
+	return merkleSubProof(m, leaves, true)
+}
+
+func merkleSubProof(m int, leaves [][]byte, complete bool) [][]byte {
+	n := len(leaves)
+	if m == n {
+		if complete {
+			return [][]byte{}
+		}
+		return [][]byte{MerkleRoot(leaves)}
+	}
+	k := largestPowerOfTwoBelow(n)
+	if m <= k {
+		return append(merkleSubProof(m, leaves[:k], complete), MerkleRoot(leaves[k:]))
+	}
+	return append(merkleSubProof(m-k, leaves[k:], false), MerkleRoot(leaves[:k]))
+}
+
+// MerkleTree is an append-only tree that keeps the hash of every complete subtree, so the
+// root and proofs for any size take O(log n) stored nodes instead of rehashing every leaf.
+// It produces the same hashes as MerkleRoot, MerkleInclusionProof and MerkleConsistencyProof.
+type MerkleTree struct {
+	levels [][][]byte // levels[h][i] is the hash of leaves [i<<h, (i+1)<<h)
+}
+
+// Size returns the number of leaves in the tree.
+func (t *MerkleTree) Size() int {
+	if len(t.levels) == 0 {
+		return 0
+	}
+	return len(t.levels[0])
+}
+
+// Append adds an already hashed leaf and the subtrees it completes.
+func (t *MerkleTree) Append(leaf []byte) {
+	if len(t.levels) == 0 {
+		t.levels = append(t.levels, nil)
+	}
+	t.levels[0] = append(t.levels[0], leaf)
+	for h := 0; len(t.levels[h])%2 == 0; h++ {
+		if h+1 == len(t.levels) {
+			t.levels = append(t.levels, nil)
+		}
+		n := len(t.levels[h])
+		t.levels[h+1] = append(t.levels[h+1], merkleNodeHash(t.levels[h][n-2], t.levels[h][n-1]))
+	}
+}
+
+// Root returns the tree head over the first size leaves.
+func (t *MerkleTree) Root(size int) []byte {
+	return t.subtreeHash(0, size)
+}
+
+// InclusionProof returns the audit path for leaf index m in the tree of the first size leaves.
+func (t *MerkleTree) InclusionProof(m, size int) [][]byte {
+	return t.inclusionProof(m, 0, size)
+}
+
+// ConsistencyProof proves that the tree of the first m leaves is a prefix of the tree of the first size leaves.
+func (t *MerkleTree) ConsistencyProof(m, size int) [][]byte {
+	if m <= 0 || m >= size {
+		return [][]byte{}
+	}
+	return t.subProof(m, 0, size, true)
+}
+
+// subtreeHash hashes leaves [start, start+n). The ranges visited by the RFC 6962 recursion
+// split into aligned power of two ranges, which are stored.
+func (t *MerkleTree) subtreeHash(start, n int) []byte {
+	switch {
+	case n == 0:
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	case n&(n-1) == 0:
+		h := bits.TrailingZeros(uint(n))
+		return t.levels[h][start>>h]
+	}
+	k := largestPowerOfTwoBelow(n)
+	return merkleNodeHash(t.subtreeHash(start, k), t.subtreeHash(start+k, n-k))
+}
+
+func (t *MerkleTree) inclusionProof(m, start, n int) [][]byte {
+	if n <= 1 {
+		return [][]byte{}
+	}
+	k := largestPowerOfTwoBelow(n)
+	if m < k {
+		return append(t.inclusionProof(m, start, k), t.subtreeHash(start+k, n-k))
+	}
+	return append(t.inclusionProof(m-k, start+k, n-k), t.subtreeHash(start, k))
+}
+
+func (t *MerkleTree) subProof(m, start, n int, complete bool) [][]byte {
+	if m == n {
+		if complete {
+			return [][]byte{}
+		}
+		return [][]byte{t.subtreeHash(start, n)}
+	}
+	k := largestPowerOfTwoBelow(n)
+	if m <= k {
+		return append(t.subProof(m, start, k, complete), t.subtreeHash(start+k, n-k))
+	}
+	return append(t.subProof(m-k, start+k, n-k, false), t.subtreeHash(start, k))
+}
@@ -0,0 +1,313 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// Leaves and tree heads from the RFC 6962 test vectors used by certificate-transparency-go.
+var rfc6962Leaves = []string{
+	"",
+	"00",
+	"10",
+	"2021",
+	"3031",
+	"40414243",
+	"5051525354555657",
+	"606162636465666768696a6b6c6d6e6f",
+}
+
+func rfc6962LeafHashes(t *testing.T) [][]byte {
+	t.Helper()
+	hashes := make([][]byte, len(rfc6962Leaves))
+	for i, leaf := range rfc6962Leaves {
+		hashes[i] = MerkleLeafHash(mustHex(t, leaf))
+	}
+	return hashes
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("bad hex %q: %v", s, err)
+	}
+	return b
+}
+
+func hexPath(t *testing.T, path ...string) [][]byte {
+	out := make([][]byte, len(path))
+	for i, p := range path {
+		out[i] = mustHex(t, p)
+	}
+	return out
+}
+
+// verifyInclusion checks an audit path as described in RFC 9162 section 2.1.3.2.
+func verifyInclusion(index, size int, leaf []byte, path [][]byte, root []byte) bool {
+	if index >= size {
+		return false
+	}
+	fn, sn, r := index, size-1, leaf
+	for _, p := range path {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = merkleNodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = merkleNodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(r, root)
+}
+
+// verifyConsistency checks a consistency proof as described in RFC 9162 section 2.1.4.2.
+func verifyConsistency(first, second int, firstRoot, secondRoot []byte, path [][]byte) bool {
+	if first == second {
+		return len(path) == 0 && bytes.Equal(firstRoot, secondRoot)
+	}
+	if first == 0 || first > second {
+		return false
+	}
+	if first&(first-1) == 0 {
+		path = append([][]byte{firstRoot}, path...)
+	}
+	if len(path) == 0 {
+		return false
+	}
+	fn, sn := first-1, second-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := path[0], path[0]
+	for _, c := range path[1:] {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = merkleNodeHash(c, fr)
+			sr = merkleNodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = merkleNodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(fr, firstRoot) && bytes.Equal(sr, secondRoot)
+}
+
+func TestMerkleRoot(t *testing.T) {
+	tests := []struct {
+		size int
+		root string
+	}{
+		{0, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{1, "6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d"},
+		{2, "fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125"},
+		{3, "aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77"},
+		{4, "d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7"},
+		{5, "4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4"},
+		{6, "76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef"},
+		{7, "ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c"},
+		{8, "5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328"},
+	}
+
+	leaves := rfc6962LeafHashes(t)
+	for _, tt := range tests {
+		if got := hex.EncodeToString(MerkleRoot(leaves[:tt.size])); got != tt.root {
+			t.Errorf("MerkleRoot(size %d) = %s, want %s", tt.size, got, tt.root)
+		}
+	}
+}
+
+func TestMerkleInclusionProofVectors(t *testing.T) {
+	tests := []struct {
+		index, size int
+		path        [][]byte
+	}{
+		{0, 1, nil},
+		{0, 8, hexPath(t,
+			"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+		)},
+		{5, 8, hexPath(t,
+			"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+			"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+			"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+		)},
+		{2, 3, hexPath(t,
+			"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+		)},
+		{1, 5, hexPath(t,
+			"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+		)},
+	}
+
+	leaves := rfc6962LeafHashes(t)
+	for _, tt := range tests {
+		got := MerkleInclusionProof(tt.index, leaves[:tt.size])
+		if len(got) != len(tt.path) {
+			t.Errorf("MerkleInclusionProof(%d, size %d) has %d hashes, want %d", tt.index, tt.size, len(got), len(tt.path))
+			continue
+		}
+		for i := range got {
+			if !bytes.Equal(got[i], tt.path[i]) {
+				t.Errorf("MerkleInclusionProof(%d, size %d)[%d] = %x, want %x", tt.index, tt.size, i, got[i], tt.path[i])
+			}
+		}
+	}
+}
+
+func TestMerkleConsistencyProofVectors(t *testing.T) {
+	tests := []struct {
+		first, second int
+		path          [][]byte
+	}{
+		{1, 1, nil},
+		{1, 8, hexPath(t,
+			"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+		)},
+		{6, 8, hexPath(t,
+			"0ebc5d3437fbe2db158b9f126a1d118e308181031d0a949f8dededebc558ef6a",
+			"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+			"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+		)},
+		{2, 5, hexPath(t,
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+		)},
+	}
+
+	leaves := rfc6962LeafHashes(t)
+	for _, tt := range tests {
+		got := MerkleConsistencyProof(tt.first, leaves[:tt.second])
+		if len(got) != len(tt.path) {
+			t.Errorf("MerkleConsistencyProof(%d, size %d) has %d hashes, want %d", tt.first, tt.second, len(got), len(tt.path))
+			continue
+		}
+		for i := range got {
+			if !bytes.Equal(got[i], tt.path[i]) {
+				t.Errorf("MerkleConsistencyProof(%d, size %d)[%d] = %x, want %x", tt.first, tt.second, i, got[i], tt.path[i])
+			}
+		}
+	}
+}
+
+func testLeaves(n int) [][]byte {
+	leaves := make([][]byte, n)
+	for i := range leaves {
+		leaves[i] = MerkleLeafHash([]byte{byte(i), byte(i >> 8)})
+	}
+	return leaves
+}
+
+func TestMerkleInclusionProofVerifies(t *testing.T) {
+	for size := 1; size <= 33; size++ {
+		leaves := testLeaves(size)
+		root := MerkleRoot(leaves)
+		for index := 0; index < size; index++ {
+			proof := MerkleInclusionProof(index, leaves)
+			if !verifyInclusion(index, size, leaves[index], proof, root) {
+				t.Fatalf("inclusion proof for leaf %d of %d does not verify", index, size)
+			}
+			if size > 1 && verifyInclusion(index, size, leaves[(index+1)%size], proof, root) {
+				t.Fatalf("inclusion proof for leaf %d of %d verifies another leaf", index, size)
+			}
+		}
+	}
+}
+
+func TestMerkleConsistencyProofVerifies(t *testing.T) {
+	for size := 2; size <= 33; size++ {
+		leaves := testLeaves(size)
+		root := MerkleRoot(leaves)
+		for first := 1; first < size; first++ {
+			firstRoot := MerkleRoot(leaves[:first])
+			proof := MerkleConsistencyProof(first, leaves)
+			if !verifyConsistency(first, size, firstRoot, root, proof) {
+				t.Fatalf("consistency proof from %d to %d does not verify", first, size)
+			}
+
+			forked := append([][]byte{}, leaves[:first]...)
+			forked[first-1] = MerkleLeafHash([]byte("forked"))
+			if verifyConsistency(first, size, MerkleRoot(forked), root, proof) {
+				t.Fatalf("consistency proof from %d to %d verifies a rewritten history", first, size)
+			}
+		}
+	}
+}
+
+func TestMerkleProofEdgeCases(t *testing.T) {
+	leaves := testLeaves(4)
+	tests := []struct {
+		name  string
+		proof [][]byte
+	}{
+		{"inclusion in a single leaf tree", MerkleInclusionProof(0, leaves[:1])},
+		{"consistency with an empty tree", MerkleConsistencyProof(0, leaves)},
+		{"consistency with the same tree", MerkleConsistencyProof(4, leaves)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.proof == nil || len(tt.proof) != 0 {
+				t.Errorf("proof = %x, want empty", tt.proof)
+			}
+		})
+	}
+}
+
+func TestMerkleTreeMatchesLeafFunctions(t *testing.T) {
+	leaves := testLeaves(33)
+	var tree MerkleTree
+	for _, leaf := range leaves {
+		tree.Append(leaf)
+	}
+	if tree.Size() != len(leaves) {
+		t.Fatalf("Size = %d, want %d", tree.Size(), len(leaves))
+	}
+
+	equal := func(a, b [][]byte) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !bytes.Equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	for size := 0; size <= len(leaves); size++ {
+		if !bytes.Equal(tree.Root(size), MerkleRoot(leaves[:size])) {
+			t.Fatalf("Root(%d) differs from MerkleRoot", size)
+		}
+		for m := 0; m < size; m++ {
+			if !equal(tree.InclusionProof(m, size), MerkleInclusionProof(m, leaves[:size])) {
+				t.Fatalf("InclusionProof(%d, %d) differs from MerkleInclusionProof", m, size)
+			}
+		}
+		for m := 0; m <= size; m++ {
+			if !equal(tree.ConsistencyProof(m, size), MerkleConsistencyProof(m, leaves[:size])) {
+				t.Fatalf("ConsistencyProof(%d, %d) differs from MerkleConsistencyProof", m, size)
+			}
+		}
+	}
+}
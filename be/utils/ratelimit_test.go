@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+// rewind moves every bucket of l back in time by d, as if d had passed.
+func rewind(l *RateLimiter, d time.Duration) {
+	for _, b := range l.buckets {
+		b.updated = b.updated.Add(-d)
+	}
+	l.lastSweep = l.lastSweep.Add(-d)
+}
+
+type limiterStep struct {
+	after time.Duration
+	key   string
+	allow bool
+}
+
+func TestRateLimiter(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		per   time.Duration
+		burst int
+		steps []limiterStep
+	}{
+		{
+			name: "burst then empty", limit: 60, per: time.Minute, burst: 3,
+			steps: []limiterStep{{0, "a", true}, {0, "a", true}, {0, "a", true}, {0, "a", false}},
+		},
+		{
+			name: "keys have their own bucket", limit: 60, per: time.Minute, burst: 1,
+			steps: []limiterStep{{0, "a", true}, {0, "a", false}, {0, "b", true}, {0, "b", false}},
+		},
+		{
+			name: "refills at the configured rate", limit: 60, per: time.Minute, burst: 2,
+			steps: []limiterStep{
+				{0, "a", true}, {0, "a", true}, {0, "a", false},
+				{500 * time.Millisecond, "a", false},
+				{600 * time.Millisecond, "a", true}, {0, "a", false},
+			},
+		},
+		{
+			name: "never refills above burst", limit: 60, per: time.Minute, burst: 2,
+			steps: []limiterStep{
+				{0, "a", true}, {0, "a", true},
+				{time.Hour, "a", true}, {0, "a", true}, {0, "a", false},
+			},
+		},
+		{
+			name: "slow rate", limit: 5, per: time.Minute, burst: 1,
+			steps: []limiterStep{
+				{0, "a", true},
+				{11 * time.Second, "a", false},
+				{2 * time.Second, "a", true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewRateLimiter(tt.limit, tt.per, tt.burst)
+			for i, step := range tt.steps {
+				rewind(l, step.after)
+				allowed, wait := l.Allow(step.key)
+				if allowed != step.allow {
+					t.Fatalf("step %d: Allow(%q) = %v, want %v", i, step.key, allowed, step.allow)
+				}
+				if allowed && wait != 0 {
+					t.Fatalf("step %d: allowed with wait %s", i, wait)
+				}
+				if !allowed && (wait <= 0 || wait > tt.per/time.Duration(tt.limit)) {
+					t.Fatalf("step %d: wait %s, want within one token interval", i, wait)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterSweepsIdleBuckets(t *testing.T) {
+	l := NewRateLimiter(60, time.Minute, 2)
+	l.Allow("idle")
+	l.Allow("busy")
+
+	rewind(l, 2*time.Minute)
+	l.Allow("busy")
+
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("idle bucket was not swept")
+	}
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Error("bucket in use was swept")
+	}
+}
@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	usernameMinLength = 3
+	usernameMaxLength = 32
+)
+
+var (
+	ErrUsernameLength      = errors.New("username must be between 3 and 32 characters")
+	ErrUsernameCharacters  = errors.New("username may only contain letters, digits, '.', '_' and '-', and must start and end with a letter or digit")
+	ErrUsernameMixedScript = errors.New("username must not mix letters from different scripts")
+	ErrUsernameReserved    = errors.New("username is reserved")
+)
+
+var reservedUsernames = []string{
+	"admin", "administrator", "root", "system", "support", "help", "security",
+	"moderator", "staff", "official", "api", "www", "null", "undefined", "me",
+}
+
+// CanonicalUsername returns the form usernames are stored and compared in:
+// NFKC normalized and lower case. It does not validate the result.
+func CanonicalUsername(raw string) string {
+	return norm.NFKC.String(strings.ToLower(norm.NFKC.String(strings.TrimSpace(raw))))
+}
+
+// ValidateUsername canonicalizes raw and checks it against the username policy.
+func ValidateUsername(raw string) (string, error) {
+	username := CanonicalUsername(raw)
+
+	if n := utf8.RuneCountInString(username); n < usernameMinLength || n > usernameMaxLength {
+		return "", ErrUsernameLength
+	}
+
+	runes := []rune(username)
+	for i, r := range runes {
+		alnum := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if !alnum && !isUsernameSeparator(r) {
+			return "", ErrUsernameCharacters
+		}
+		if !alnum && (i == 0 || i == len(runes)-1) {
+			return "", ErrUsernameCharacters
+		}
+	}
+
+	if !singleScript(username) {
+		return "", ErrUsernameMixedScript
+	}
+
+	skeleton := UsernameSkeleton(username)
+	for _, reserved := range reservedUsernames {
+		if skeleton == UsernameSkeleton(reserved) {
+			return "", ErrUsernameReserved
+		}
+	}
+	return username, nil
+}
+
+func isUsernameSeparator(r rune) bool {
+	return r == '.' || r == '_' || r == '-'
+}
+
+// usernameScripts are the scripts a username may be written in. Han, Hiragana and
+// Katakana count as one script since Japanese names mix them.
+var usernameScripts = []struct {
+	name   string
+	tables []*unicode.RangeTable
+}{
+	{"latin", []*unicode.RangeTable{unicode.Latin}},
+	{"cyrillic", []*unicode.RangeTable{unicode.Cyrillic}},
+	{"greek", []*unicode.RangeTable{unicode.Greek}},
+	{"arabic", []*unicode.RangeTable{unicode.Arabic}},
+	{"hebrew", []*unicode.RangeTable{unicode.Hebrew}},
+	{"thai", []*unicode.RangeTable{unicode.Thai}},
+	{"hangul", []*unicode.RangeTable{unicode.Hangul}},
+	{"cjk", []*unicode.RangeTable{unicode.Han, unicode.Hiragana, unicode.Katakana}},
+}
+
+// singleScript reports whether all letters of s belong to one of usernameScripts.
+// Digits and separators are shared by every script.
+func singleScript(s string) bool {
+	script := ""
+	for _, r := range s {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		found := ""
+		for _, candidate := range usernameScripts {
+			if unicode.In(r, candidate.tables...) {
+				found = candidate.name
+				break
+			}
+		}
+		if found == "" || (script != "" && found != script) {
+			return false
+		}
+		script = found
+	}
+	return true
+}
+
+// confusables maps characters that are commonly used to impersonate a name to the
+// latin letter they look like.
+var confusables = map[rune]string{
+	// cyrillic
+	'а': "a", 'в': "b", 'е': "e", 'ё': "e", 'һ': "h", 'і': "i", 'ї': "i", 'ј': "j", 'к': "k",
+	'ӏ': "l", 'м': "m", 'н': "h", 'о': "o", 'р': "p", 'с': "c", 'т': "t", 'у': "y", 'х': "x",
+	'ѕ': "s", 'ԁ': "d", 'ԛ': "q", 'ԝ': "w", 'ь': "b", 'г': "r", 'п': "n",
+	// greek
+	'α': "a", 'β': "b", 'ε': "e", 'η': "n", 'ι': "i", 'κ': "k", 'μ': "u", 'ν': "v", 'ο': "o",
+	'ρ': "p", 'τ': "t", 'υ': "u", 'χ': "x", 'γ': "y", 'ω': "w",
+	// digits and latin look-alikes
+	'0': "o", '1': "l", 'i': "l", '3': "e", '5': "s", '8': "b",
+}
+
+// UsernameSkeleton reduces a canonical username to a form in which look-alike names
+// collide, e.g. "paypal" and "pаypal" with a cyrillic а. Separators are dropped and
+// accents stripped.
+func UsernameSkeleton(username string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(username) {
+		if unicode.Is(unicode.Mn, r) || isUsernameSeparator(r) {
+			continue
+		}
+		if s, ok := confusables[r]; ok {
+			b.WriteString(s)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	skeleton := b.String()
+	skeleton = strings.ReplaceAll(skeleton, "rn", "m")
+	skeleton = strings.ReplaceAll(skeleton, "vv", "w")
+	return skeleton
+}
@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalUsername(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{"already canonical", "alice", "alice"},
+		{"upper case", "Alice", "alice"},
+		{"surrounding space", "  bob\t", "bob"},
+		{"fullwidth letters", "Ｂｏｂ", "bob"},
+		{"ligature", "ﬁnn", "finn"},
+		{"angstrom sign", "\u212bke", "\u00e5ke"},
+		{"decomposed accent is composed", "jose\u0301", "jos\u00e9"},
+		{"roman numeral", "louisⅨ", "louisix"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CanonicalUsername(tt.raw); got != tt.want {
+				t.Errorf("CanonicalUsername(%q) = %q, want %q", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateUsername(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    string
+		wantErr error
+	}{
+		{"plain", "alice", "alice", nil},
+		{"canonicalized", "Alice.Smith", "alice.smith", nil},
+		{"fullwidth", "ｊｏｈｎ_doe", "john_doe", nil},
+		{"digits", "bob42", "bob42", nil},
+		{"cyrillic only", "иван", "иван", nil},
+		{"japanese mixes han and kana", "山田たろう", "山田たろう", nil},
+		{"too short", "ab", "", ErrUsernameLength},
+		{"too long", strings.Repeat("a", 33), "", ErrUsernameLength},
+		{"space inside", "bo b", "", ErrUsernameCharacters},
+		{"symbol", "bob!", "", ErrUsernameCharacters},
+		{"leading separator", "_bob", "", ErrUsernameCharacters},
+		{"trailing separator", "bob.", "", ErrUsernameCharacters},
+		{"cyrillic a in latin name", "pаypal", "", ErrUsernameMixedScript},
+		{"greek o in latin name", "bοb", "", ErrUsernameMixedScript},
+		{"reserved", "Admin", "", ErrUsernameReserved},
+		{"reserved look-alike", "adm1n", "", ErrUsernameReserved},
+		{"reserved with separator", "r.o.o.t", "", ErrUsernameReserved},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ValidateUsername(tt.raw)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ValidateUsername(%q) error = %v, want %v", tt.raw, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ValidateUsername(%q) = %q, want %q", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUsernameSkeleton(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    string
+		collide bool
+	}{
+		{"cyrillic look-alike", "paypal", "pаypal", true},
+		{"whole name in cyrillic", "pay", "рау", true},
+		{"greek look-alike", "bob", "bοb", true},
+		{"digit for letter", "bob", "b0b", true},
+		{"one for l and i", "bill", "b1ll", true},
+		{"accent stripped", "jose", "josé", true},
+		{"separators dropped", "jdoe", "j.doe", true},
+		{"rn looks like m", "mary", "rnary", true},
+		{"vv looks like w", "will", "vvill", true},
+		{"different names", "alice", "alicia", false},
+		{"different letters", "bob", "rob", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := UsernameSkeleton(tt.a), UsernameSkeleton(tt.b)
+			if (a == b) != tt.collide {
+				t.Errorf("UsernameSkeleton(%q) = %q, UsernameSkeleton(%q) = %q, collide = %v", tt.a, a, tt.b, b, tt.collide)
+			}
+		})
+	}
+}
@@ -1,7 +1,7 @@
 import SendRoundedIcon from '@mui/icons-material/SendRounded';
 import IconButton from '@mui/material/IconButton';
 import { useEffect, useRef, useState } from 'react';
-import { sendRaw } from '../services/chatSocket';
+import { sendFrame } from '../services/chatSocket';
 import type { TypingBoxProps } from '../types/chat';
 import { fromHex, hashMessage, signHashHex } from '../utils/crypto';
 import { encryptMessage } from '../utils/ecc-ecdh';
@@ -57,7 +57,7 @@ export default function TypingBox({
         value
       );
 
-      sendRaw({
+      sendFrame('message', {
         sender_username: me,
         receiver_username: to,
         encrypted_message: encrypted,
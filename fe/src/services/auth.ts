@@ -5,6 +5,7 @@ import type {
   ResponseChallenge,
   Token,
 } from '../types/auth';
+import { normalizeUsername } from '../utils/auth';
 import { fromHex, generateKeyPair, signNonce, toHex } from '../utils/crypto';
 import { generateDeterministicIdentityKeyPair } from '../utils/ecc-ecdh';
 import { getEnv } from '../utils/env';
@@ -15,7 +16,9 @@ export class AuthService extends ApiClient {
     super(getEnv('VITE_API_BASE_URL', 'http:/localhost:8080/api/'), token);
   }
 
-  async register({ username, password }: AuthInput): Promise<string> {
+  async register(input: AuthInput): Promise<string> {
+    const username = normalizeUsername(input.username);
+    const { password } = input;
     const { privateKeyHex, publicKeyHex } = await generateKeyPair(
       username,
       password
@@ -25,27 +28,49 @@ export class AuthService extends ApiClient {
     const publicEcdhHex = toHex(publicKeyEcdh)
     publicKeyHex.ecdh = publicEcdhHex
 
+    const challengeRes = await this.get<BaseResponse<ResponseChallenge>>(
+      `/register/challenge?username=${encodeURIComponent(username)}`
+    );
+    const nonce = challengeRes.data.nonce;
+    const statement = [
+      'register',
+      username,
+      publicKeyHex.x,
+      publicKeyHex.y,
+      publicEcdhHex,
+      nonce,
+    ].join('|');
+    const signature = await signNonce(
+      privateKeyHex,
+      toHex(new TextEncoder().encode(statement))
+    );
+
     return this.post<BaseResponse<string>>(
       '/register',
-      { username, publicKeyHex },
+      { username, publicKeyHex, nonce, signature },
       { withCredentials: true }
     ).then((res) => {
       return res.data;
     });
   }
 
-  async login({ username, password }: AuthInput): Promise<AuthResponse> {
+  async login(input: AuthInput): Promise<AuthResponse> {
+    const { password } = input;
     try {
+      // username dikirim apa adanya, server mencocokkan persis lalu bentuk kanonisnya
       const nonceRes = await this.get<BaseResponse<ResponseChallenge>>(
-        `/nonce?username=${username}`
+        `/nonce?username=${encodeURIComponent(input.username.trim())}`
       );
       const nonce = nonceRes.data.nonce;
-      const { privateKeyHex } = await generateKeyPair(username, password);
+      const username = nonceRes.data.username ?? normalizeUsername(input.username);
+      // akun lama menurunkan kunci dari username aslinya sebelum dinormalisasi
+      const keyUsername = nonceRes.data.key_username ?? username;
+      const { privateKeyHex } = await generateKeyPair(keyUsername, password);
       const signature = await signNonce(privateKeyHex, nonce);
       const { privateKeyEcdh } = await generateDeterministicIdentityKeyPair(fromHex(privateKeyHex))
       return this.post<BaseResponse<AuthResponse>>(
         '/login',
-        { username, signature: signature },
+        { username, nonce, signature: signature },
         { withCredentials: true }
       ).then((res) => {
         localStorage.setItem('privateKey', privateKeyHex);
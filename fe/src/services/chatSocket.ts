@@ -12,6 +12,7 @@ import {
   verifySignature,
 } from '../utils/crypto';
 import { decryptMessage } from '../utils/ecc-ecdh';
+import { AuthService } from './auth';
 import { UserApi } from './user';
 
 export interface FriendListChangedNotification {
@@ -23,8 +24,31 @@ export interface FriendListChangedNotification {
   };
 }
 
+// Setiap frame dibungkus envelope { type, id, v, payload }, lihat be/README.md
+export const PROTOCOL_VERSION = 1;
+
+export interface Envelope<T = unknown> {
+  type: string;
+  id?: string;
+  v: number;
+  payload?: T;
+}
+
 let ws: WebSocket | null = null;
 let currentUser: string | null = null;
+// selama replay pesan yang terlewat, ack dikirim sekali saja setelah frame `synced`
+let syncing = false;
+
+// ID pesan terakhir yang sudah diterima, dikirim di hello supaya server me-replay sisanya
+function cursorKey(username: string) {
+  return `lastMessageId:${username}`;
+}
+
+function advanceCursor(username: string, id: string) {
+  const current = Number(localStorage.getItem(cursorKey(username)) ?? 0);
+  if (Number(id) > current) localStorage.setItem(cursorKey(username), id);
+}
+
 const listeners: ((m: VerifiedChatMessage) => void)[] = [];
 const friendListeners: ((
   notification: FriendListChangedNotification
@@ -33,18 +57,67 @@ const friendListeners: ((
 export function initChatSocket(token: string | undefined, username: string) {
   currentUser = username;
   if (ws && ws.readyState === WebSocket.OPEN) return ws;
-  ws = new WebSocket(
-    `${import.meta.env.VITE_API_BASE_URL}/ws/chat?token=${token}`
-  );
+  // token dikirim lewat subprotocol, bukan query string, supaya tidak tercatat di log
+  ws = new WebSocket(`${import.meta.env.VITE_API_BASE_URL}/ws/chat`, [
+    'e2e-chat',
+    `access_token.${token}`,
+  ]);
+  ws.onopen = () => {
+    const lastMessageId = localStorage.getItem(cursorKey(username));
+    syncing = lastMessageId !== null;
+    sendFrame('hello', {
+      versions: [PROTOCOL_VERSION],
+      ...(lastMessageId !== null && { last_message_id: lastMessageId }),
+    });
+  };
   ws.onmessage = async (ev) => {
     try {
-      const data = JSON.parse(ev.data);
+      const frame: Envelope<any> = JSON.parse(ev.data);
+
+      if (frame.type === 'friendlist_changed') {
+        friendListeners.forEach((l) =>
+          l({ type: 'friendlist_changed', data: frame.payload })
+        );
+        return;
+      }
 
-      if (data.type === 'friendlist_changed') {
-        friendListeners.forEach((l) => l(data));
+      // token socket hampir kedaluwarsa, kirim token baru tanpa reconnect
+      if (frame.type === 'reauth_required') {
+        const res = await new AuthService(token).refreshToken();
+        token = res.access_token;
+        sendFrame('reauth', { token });
         return;
       }
 
+      if (frame.type === 'error') {
+        console.error('WS error', frame.id, frame.payload);
+        return;
+      }
+
+      // pertama kali terhubung, mulai dari cursor yang tersimpan di server
+      if (frame.type === 'welcome') {
+        if (localStorage.getItem(cursorKey(username)) === null) {
+          localStorage.setItem(cursorKey(username), frame.payload.cursor ?? '0');
+        }
+        return;
+      }
+
+      if (frame.type === 'synced') {
+        syncing = false;
+        advanceCursor(username, frame.payload.last_message_id);
+        if (frame.payload.replayed > 0) {
+          sendFrame('ack', { message_id: frame.payload.last_message_id });
+        }
+        return;
+      }
+
+      if (frame.type !== 'message') return;
+      const data = frame.payload;
+      if (data.id) {
+        advanceCursor(username, data.id);
+        if (!syncing) sendFrame('ack', { message_id: data.id });
+      }
+
       if (!currentUser || data.receiver_username !== currentUser) return;
       const api = new UserApi(token);
       const pubReceiver = await api.fetchPublicKey(data.sender_username);
@@ -96,9 +169,16 @@ export function initChatSocket(token: string | undefined, username: string) {
   return ws;
 }
 
-export function sendRaw(payload: unknown) {
+export function sendFrame(type: string, payload: unknown) {
   if (!ws || ws.readyState !== WebSocket.OPEN) return;
-  ws.send(JSON.stringify(payload));
+  const frame: Envelope = {
+    type,
+    id: crypto.randomUUID(),
+    v: PROTOCOL_VERSION,
+    payload,
+  };
+  ws.send(JSON.stringify(frame));
+  return frame.id;
 }
 
 export function onIncomingMessage(cb: (m: VerifiedChatMessage) => void) {
@@ -110,8 +190,7 @@ export function onIncomingMessage(cb: (m: VerifiedChatMessage) => void) {
 }
 
 export function sendChatPayload(payload: OutgoingSignedEncryptedPayload) {
-  if (!ws || ws.readyState !== WebSocket.OPEN) return;
-  ws.send(JSON.stringify(payload));
+  return sendFrame('message', payload);
 }
 
 export async function fetchChatHistory(
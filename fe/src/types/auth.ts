@@ -10,6 +10,7 @@ export type AuthInput = {
 
 export type LoginPayload = {
   username: string;
+  nonce: string;
   signature: Signature;
 };
 
@@ -26,6 +27,9 @@ export type PublicKey = {
 
 export type ResponseChallenge = {
   nonce: string
+  // hanya pada challenge login: username tersimpan dan username untuk menurunkan kunci
+  username?: string
+  key_username?: string
 }
 
 export type KeyPair = {
@@ -17,6 +17,7 @@ export interface IncomingPayload {
   message_hash: string;
   signature: { r: string; s: string };
   timestamp: string;
+  verified_at?: string;
 }
 
 export interface VerifiedChatMessage {
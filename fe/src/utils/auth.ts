@@ -9,14 +9,22 @@ export const validatePassword = (value: string) => {
   return rules.filter((r) => !r.test).map((r) => r.message);
 };
 
+// Harus sama dengan utils.CanonicalUsername di backend, karena username ikut menurunkan kunci.
+export const normalizeUsername = (value: string) =>
+  value.trim().normalize("NFKC").toLowerCase().normalize("NFKC");
+
 export const validateAuthForm = (
   isLogin: boolean,
   formValues: { username: string; password: string }
 ) => {
   const errors = { username: "", password: "" };
 
-  if (!formValues.username.trim()) {
+  const username = normalizeUsername(formValues.username);
+  if (!username) {
     errors.username = "Username wajib diisi";
+  } else if (!isLogin && !/^[\p{L}\p{Nd}]([\p{L}\p{Nd}._-]{1,30}[\p{L}\p{Nd}])$/u.test(username)) {
+    errors.username =
+      "Username 3-32 karakter, hanya huruf, angka, '.', '_' dan '-'";
   }
   if (!formValues.password.trim()) {
     errors.password = "Password wajib diisi";
@@ -0,0 +1,80 @@
+import assert from 'node:assert/strict';
+import { describe, it } from 'node:test';
+import { combineShares, splitSecret, type Share } from './shamir.ts';
+
+const randomSecret = (length: number) =>
+  crypto.getRandomValues(new Uint8Array(length));
+
+// semua kombinasi k share dari shares, urutan tetap
+const subsets = (shares: Share[], k: number): Share[][] => {
+  if (k === 0) return [[]];
+  if (shares.length < k) return [];
+  const [first, ...rest] = shares;
+  return [
+    ...subsets(rest, k - 1).map((s) => [first, ...s]),
+    ...subsets(rest, k),
+  ];
+};
+
+describe('splitSecret / combineShares', () => {
+  const cases = [
+    { name: '2 dari 3', shares: 3, threshold: 2, length: 32 },
+    { name: '3 dari 5', shares: 5, threshold: 3, length: 32 },
+    { name: 'semua share dibutuhkan', shares: 4, threshold: 4, length: 16 },
+    { name: 'secret satu byte', shares: 3, threshold: 2, length: 1 },
+  ];
+
+  for (const tc of cases) {
+    it(`${tc.name}: setiap ${tc.threshold} share mengembalikan secret`, () => {
+      const secret = randomSecret(tc.length);
+      const shares = splitSecret(secret, tc.shares, tc.threshold);
+
+      assert.equal(shares.length, tc.shares);
+      assert.deepEqual(
+        shares.map((s) => s.index),
+        Array.from({ length: tc.shares }, (_, i) => i + 1)
+      );
+      for (const subset of subsets(shares, tc.threshold)) {
+        assert.deepEqual(combineShares(subset), secret);
+        assert.deepEqual(combineShares([...subset].reverse()), secret);
+      }
+    });
+
+    it(`${tc.name}: lebih dari threshold share juga mengembalikan secret`, () => {
+      const secret = randomSecret(tc.length);
+      const shares = splitSecret(secret, tc.shares, tc.threshold);
+      assert.deepEqual(combineShares(shares), secret);
+    });
+  }
+
+  it('kurang dari threshold share tidak mengembalikan secret', () => {
+    const secret = randomSecret(32);
+    const shares = splitSecret(secret, 5, 3);
+    for (const subset of subsets(shares, 2)) {
+      assert.notDeepEqual(combineShares(subset), secret);
+    }
+  });
+
+  it('share berbeda setiap kali dipecah', () => {
+    const secret = randomSecret(32);
+    const a = splitSecret(secret, 3, 2);
+    const b = splitSecret(secret, 3, 2);
+    assert.notDeepEqual(a[0].data, b[0].data);
+  });
+
+  const invalid = [
+    { name: 'threshold 1', shares: 3, threshold: 1 },
+    { name: 'threshold melebihi jumlah share', shares: 2, threshold: 3 },
+    { name: 'lebih dari 255 share', shares: 256, threshold: 2 },
+  ];
+  for (const tc of invalid) {
+    it(`menolak ${tc.name}`, () => {
+      assert.throws(() => splitSecret(randomSecret(8), tc.shares, tc.threshold));
+    });
+  }
+
+  it('menolak menggabungkan kurang dari dua share', () => {
+    const [share] = splitSecret(randomSecret(8), 3, 2);
+    assert.throws(() => combineShares([share]));
+  });
+});
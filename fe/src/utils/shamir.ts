@@ -0,0 +1,79 @@
+// Shamir secret sharing over GF(2^8), byte per byte. Dipakai untuk social recovery:
+// kunci pemulihan dipecah menjadi share, tiap share dienkripsi ke kunci ECDH teman.
+
+export type Share = {
+  index: number; // 1..255, titik x dari polinomial
+  data: Uint8Array;
+};
+
+const EXP = new Uint8Array(510);
+const LOG = new Uint8Array(256);
+(() => {
+  let x = 1;
+  for (let i = 0; i < 255; i++) {
+    EXP[i] = x;
+    LOG[x] = i;
+    // kali 3 (generator) modulo x^8 + x^4 + x^3 + x + 1
+    x ^= (x << 1) ^ (x & 0x80 ? 0x11b : 0);
+    x &= 0xff;
+  }
+  for (let i = 255; i < 510; i++) EXP[i] = EXP[i - 255];
+})();
+
+const mul = (a: number, b: number) =>
+  a === 0 || b === 0 ? 0 : EXP[LOG[a] + LOG[b]];
+
+const div = (a: number, b: number) => {
+  if (b === 0) throw new Error('division by zero');
+  return a === 0 ? 0 : EXP[LOG[a] + 255 - LOG[b]];
+};
+
+export function splitSecret(
+  secret: Uint8Array,
+  shares: number,
+  threshold: number
+): Share[] {
+  if (threshold < 2 || threshold > shares || shares > 255) {
+    throw new Error('invalid threshold or share count');
+  }
+  const out: Share[] = Array.from({ length: shares }, (_, i) => ({
+    index: i + 1,
+    data: new Uint8Array(secret.length),
+  }));
+  const coeffs = new Uint8Array(threshold);
+  for (let b = 0; b < secret.length; b++) {
+    crypto.getRandomValues(coeffs);
+    coeffs[0] = secret[b];
+    for (const share of out) {
+      // Horner: f(x) = c0 + x(c1 + x(c2 + ...))
+      let y = 0;
+      for (let c = threshold - 1; c >= 0; c--) {
+        y = mul(y, share.index) ^ coeffs[c];
+      }
+      share.data[b] = y;
+    }
+  }
+  return out;
+}
+
+export function combineShares(shares: Share[]): Uint8Array {
+  if (shares.length < 2) throw new Error('not enough shares');
+  const length = shares[0].data.length;
+  const secret = new Uint8Array(length);
+  for (let b = 0; b < length; b++) {
+    // interpolasi Lagrange di x = 0
+    let y = 0;
+    for (const i of shares) {
+      let num = 1;
+      let den = 1;
+      for (const j of shares) {
+        if (i.index === j.index) continue;
+        num = mul(num, j.index);
+        den = mul(den, i.index ^ j.index);
+      }
+      y ^= mul(i.data[b], div(num, den));
+    }
+    secret[b] = y;
+  }
+  return secret;
+}